@@ -0,0 +1,209 @@
+package gonyexpress
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NewAggregator creates an aggregator Component instance ready to connect to
+// the rabbitmq + queue, which handles the scatter steps on that queue. It fans
+// every message out to the branches of the step, and gathers the results to
+// advance the message once enough branches have returned.
+//
+// The scatter state is kept in memory, so every aggregator queue must be
+// consumed by a single aggregator instance. The original message and the
+// branch results are only acknowledged once joined, so after a restart they are
+// redelivered, and the message is scattered anew. A message redelivered while
+// its scatter is still pending, e.g. after a reconnect, takes the place of the
+// original delivery instead. As deliveries are held for the duration of a
+// scatter, the aggregator consumes without a prefetch limit.
+func NewAggregator(URI, qname string, workers int) Component {
+	a := &aggregator{
+		scatters: map[string]*scatter{},
+	}
+
+	return Component{
+		Broker:   broker.New(URI, qname),
+		queue:    qname,
+		handle:   a.handle,
+		workers:  workers,
+		prefetch: unlimitedPrefetch,
+		wg:       sync.WaitGroup{},
+	}
+}
+
+// aggregator tracks the scatter steps awaiting the results of their branches,
+// by the Branch ID of the scatter.
+type aggregator struct {
+	mu       sync.Mutex
+	scatters map[string]*scatter
+}
+
+// scatter is the original message of a scatter step, and the results of the
+// branches returned so far. The deliveries of both are held unacknowledged
+// until the scatter is joined.
+type scatter struct {
+	msg      pl.Message
+	origin   broker.Delivery
+	results  []*pl.Message
+	held     []broker.Delivery
+	returned int
+	required int
+}
+
+// ack acknowledges the delivery, and the held branch results.
+func (s *scatter) ack(d broker.Delivery) {
+	for _, h := range s.held {
+		h.Ack()
+	}
+	d.Ack()
+}
+
+func (a *aggregator) handle(c *Component, d broker.Delivery, msg *pl.Message, step *pl.Step) {
+	switch {
+	case msg.Branch != nil && msg.Branch.Timeout:
+		a.expire(c, d, msg.Branch.ID)
+	case msg.Branch != nil:
+		a.gather(c, d, msg)
+	default:
+		a.scatter(c, d, msg, step)
+	}
+}
+
+// scatter sends the message along all branches of the step. A redelivered
+// message for a pending scatter only replaces the original delivery, which was
+// lost along with the channel it was received on.
+func (a *aggregator) scatter(c *Component, d broker.Delivery, msg *pl.Message, step *pl.Step) {
+	branches, timeout, err := msg.Scatter()
+	if err != nil {
+		c.logMessage(msg).Errorf("Failed to scatter message: %+v", err)
+		c.deadLetter(d, msg, err)
+		return
+	}
+
+	id := timeout.Branch.ID
+	a.mu.Lock()
+	if s, ok := a.scatters[id]; ok {
+		s.origin = d
+		a.mu.Unlock()
+		c.logMessage(msg).Infof("Resumed pending scatter of %d branches",
+			len(branches))
+		return
+	}
+	a.scatters[id] = &scatter{
+		msg:      *msg,
+		origin:   d,
+		results:  make([]*pl.Message, len(branches)),
+		required: step.Scatter.Required(),
+	}
+	a.mu.Unlock()
+
+	for _, branch := range branches {
+		if err = c.SendMessage(branch); err != nil {
+			a.forget(id)
+			c.failedSend(d, &branch, err)
+			return
+		}
+	}
+
+	if delay := time.Duration(step.Scatter.Timeout); delay > 0 {
+		if err = c.Broker.SendDelayedMessage(timeout, delay); err != nil {
+			a.forget(id)
+			c.failedSend(d, &timeout, err)
+			return
+		}
+	}
+
+	// The delivery is held until joined, so the message survives a restart.
+	c.logMessage(msg).Infof("Scattered message to %d branches", len(branches))
+}
+
+// gather records the result of a branch, and joins the results once enough
+// branches have returned. Results for unknown, or already joined, scatters are
+// dropped.
+func (a *aggregator) gather(c *Component, d broker.Delivery, msg *pl.Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.scatters[msg.Branch.ID]
+	if !ok || msg.Branch.Index < 0 || msg.Branch.Index >= len(s.results) {
+		c.logMessage(msg).Warnf("Dropping result of unknown branch %+v",
+			*msg.Branch)
+		d.Ack()
+		return
+	}
+
+	if s.results[msg.Branch.Index] == nil {
+		s.returned++
+	}
+	s.results[msg.Branch.Index] = msg
+
+	if s.returned < s.required {
+		s.held = append(s.held, d)
+		return
+	}
+	a.join(c, d, msg.Branch.ID, s)
+}
+
+// expire joins the results returned so far, if the scatter is still pending.
+func (a *aggregator) expire(c *Component, d broker.Delivery, id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.scatters[id]
+	if !ok {
+		d.Ack()
+		return
+	}
+
+	c.logMessage(&s.msg).Warnf("Scatter timed out with %d / %d branches returned",
+		s.returned, len(s.results))
+	a.join(c, d, id, s)
+}
+
+// join advances the original message with the results of the branches, and
+// acknowledges the original delivery, the held results, and the delivery
+// triggering the join. A failed message is dead-lettered through the original
+// delivery. If the message can't be sent, the triggering delivery is requeued,
+// and the scatter is kept to join again upon redelivery. Must be called with
+// the lock held.
+func (a *aggregator) join(c *Component, d broker.Delivery, id string, s *scatter) {
+	next, err := s.msg.Join(s.results)
+	if err != nil {
+		c.logMessage(&s.msg).Errorf("Failed to join results: %+v", err)
+		delete(a.scatters, id)
+		c.deadLetter(s.origin, &s.msg, err)
+		s.ack(d)
+		return
+	}
+
+	if next != nil {
+		if err = c.SendMessage(*next); err != nil {
+			if !errors.Is(err, broker.ErrUnroutable) {
+				c.failedSend(d, next, err)
+				return
+			}
+			delete(a.scatters, id)
+			c.failedSend(s.origin, next, err)
+			s.ack(d)
+			return
+		}
+	}
+
+	delete(a.scatters, id)
+	c.logMessage(&s.msg).Infof("Joined %d / %d branches",
+		s.returned, len(s.results))
+	s.origin.Ack()
+	s.ack(d)
+}
+
+func (a *aggregator) forget(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.scatters, id)
+}
@@ -0,0 +1,341 @@
+package gonyexpress_test
+
+import (
+	"time"
+
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"testing"
+)
+
+func scatterMessage(scatter payload.Scatter) payload.Message {
+	return payload.NewMessage(
+		payload.Routing{
+			Name: "scatter",
+			Slip: []payload.Step{
+				{Queue: "aggregator", Scatter: &scatter},
+				{Queue: "next"},
+			},
+		},
+		payload.MetaData{"meta": "data"},
+		payload.Documents{
+			"input": payload.NewDocument("Hello", "text/plain", ""),
+		},
+	)
+}
+
+// takeBranches takes the branch messages from the MockBroker, and returns them
+// by queue.
+func takeBranches(t *testing.T, m *broker.MockBroker, n int) map[string]*payload.Message {
+	t.Helper()
+
+	branches := map[string]*payload.Message{}
+	for i := 0; i < n; i++ {
+		d := m.TakeDelivery(1 * time.Second)
+		if d == nil {
+			t.Fatalf("Expected %d branch messages, got %d", n, i)
+		}
+		msg, err := payload.MessageFromByteSlice(d.Body())
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if msg.Branch == nil {
+			t.Fatalf("Expected a branch message, got %+v", msg)
+		}
+		branches[d.Queue] = msg
+	}
+	return branches
+}
+
+// returnBranch advances the branch message back to the aggregator, as the
+// consumer of the branch would.
+func returnBranch(t *testing.T, m *broker.MockBroker, msg *payload.Message, docs payload.Documents) *broker.MockDelivery {
+	t.Helper()
+
+	next, err := msg.Advance(&docs, nil)
+	if err != nil || next == nil {
+		t.Fatalf("Failed to advance branch: %+v, %+v", next, err)
+	}
+	d, err := m.DeliverMessage(*next)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	return d
+}
+
+func TestAggregator(t *testing.T) {
+	c := ge.NewAggregator("mock://", "aggregator", 1)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := scatterMessage(payload.Scatter{
+		Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+	})
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	branches := takeBranches(t, m, 2)
+
+	left := returnBranch(t, m, branches["left"], payload.Documents{
+		"left": payload.NewDocument("L", "text/plain", ""),
+	})
+	if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+		t.Fatalf("Unexpected message before all branches returned: %+v", d)
+	}
+	for name, d := range map[string]*broker.MockDelivery{
+		"scatter": delivery,
+		"left":    left,
+	} {
+		if s, _ := d.Settlement(10 * time.Millisecond); s != broker.Unsettled {
+			t.Errorf("Unexpected %s settlement before join. Have %q, want %q.",
+				name, s, broker.Unsettled)
+		}
+	}
+
+	right := returnBranch(t, m, branches["right"], payload.Documents{
+		"right": payload.NewDocument("R", "text/plain", ""),
+	})
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a joined message, got nil")
+	}
+	for name, d := range map[string]*broker.MockDelivery{
+		"scatter": delivery,
+		"left":    left,
+		"right":   right,
+	} {
+		if s, _ := d.Settlement(1 * time.Second); s != broker.Acked {
+			t.Errorf("Unexpected %s settlement after join. Have %q, want %q.",
+				name, s, broker.Acked)
+		}
+	}
+	if d.Queue != "next" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "next")
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if msg.TraceID != orig.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", msg.TraceID, orig.TraceID)
+	}
+	if msg.Branch != nil {
+		t.Errorf("Unexpected branch on joined message: %+v", msg.Branch)
+	}
+	for _, name := range []string{"input", "left", "right"} {
+		if _, ok := msg.Documents[name]; !ok {
+			t.Errorf("Joined message should contain %q document", name)
+		}
+	}
+	if _, ok := msg.MetaData[payload.GatherMissing]; ok {
+		t.Errorf("Unexpected missing branches in %+v", msg.MetaData)
+	}
+}
+
+func TestAggregatorQuorum(t *testing.T) {
+	c := ge.NewAggregator("mock://", "aggregator", 1)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := scatterMessage(payload.Scatter{
+		Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+		Quorum:   1,
+	})
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	branches := takeBranches(t, m, 2)
+	returnBranch(t, m, branches["right"], payload.Documents{})
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a joined message, got %+v, %+v", msg, err)
+	}
+	if missing := msg.MetaData[payload.GatherMissing]; missing == nil {
+		t.Errorf("Expected missing branches in %+v", msg.MetaData)
+	}
+
+	late, err := m.DeliverMessage(*branches["left"])
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if s, _ := late.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+	if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+		t.Errorf("Unexpected message for late branch: %+v", d)
+	}
+}
+
+func TestAggregatorTimeout(t *testing.T) {
+	c := ge.NewAggregator("mock://", "aggregator", 1)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := scatterMessage(payload.Scatter{
+		Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+		Timeout:  payload.Duration(time.Minute),
+	})
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	branches := takeBranches(t, m, 2)
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a timeout message, got nil")
+	}
+	if d.Queue != "aggregator" || d.Delay != time.Minute {
+		t.Errorf("Unexpected timeout message to %q after %s.", d.Queue, d.Delay)
+	}
+
+	returnBranch(t, m, branches["left"], payload.Documents{})
+
+	timeout, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if _, err = m.DeliverMessage(*timeout); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a joined message, got %+v, %+v", msg, err)
+	}
+	if msg.Routing.Position != 1 {
+		t.Errorf("Unexpected position. Have %d, want %d.", msg.Routing.Position, 1)
+	}
+	if missing := msg.MetaData[payload.GatherMissing]; missing == nil {
+		t.Errorf("Expected missing branches in %+v", msg.MetaData)
+	}
+}
+
+func TestAggregatorRestart(t *testing.T) {
+	orig := scatterMessage(payload.Scatter{
+		Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+	})
+
+	crashed := ge.NewAggregator("mock://", "aggregator", 1)
+	cm := crashed.Broker.(*broker.MockBroker)
+
+	if err := crashed.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	delivery, err := cm.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	branches := takeBranches(t, cm, 2)
+	left := returnBranch(t, cm, branches["left"], payload.Documents{})
+	crashed.Shutdown()
+
+	// Unacknowledged deliveries are redelivered after the restart
+	for name, d := range map[string]*broker.MockDelivery{
+		"scatter": delivery,
+		"left":    left,
+	} {
+		if s, _ := d.Settlement(10 * time.Millisecond); s != broker.Unsettled {
+			t.Fatalf("Unexpected %s settlement. Have %q, want %q.",
+				name, s, broker.Unsettled)
+		}
+	}
+
+	c := ge.NewAggregator("mock://", "aggregator", 1)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	// The stale result of the previous scatter is dropped
+	if s, _ := m.Deliver(left).Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected stale settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	redelivery := m.Deliver(delivery)
+	branches = takeBranches(t, m, 2)
+	returnBranch(t, m, branches["left"], payload.Documents{})
+	returnBranch(t, m, branches["right"], payload.Documents{})
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a joined message, got %+v, %+v", msg, err)
+	}
+	if msg.TraceID != orig.TraceID || msg.Routing.Position != 1 {
+		t.Errorf("Unexpected joined message: %+v", msg)
+	}
+	if s, _ := redelivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+}
+
+func TestAggregatorRedelivered(t *testing.T) {
+	c := ge.NewAggregator("mock://", "aggregator", 1)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := scatterMessage(payload.Scatter{
+		Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+	})
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	branches := takeBranches(t, m, 2)
+	returnBranch(t, m, branches["left"], payload.Documents{})
+
+	// Redelivered after the channel was lost, while the scatter is pending
+	redelivery := m.Deliver(delivery)
+	if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+		t.Fatalf("Unexpected message scattered again to %q", d.Queue)
+	}
+
+	returnBranch(t, m, branches["right"], payload.Documents{})
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a joined message, got %+v, %+v", msg, err)
+	}
+	if msg.TraceID != orig.TraceID || msg.Routing.Position != 1 {
+		t.Errorf("Unexpected joined message: %+v", msg)
+	}
+	if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+		t.Errorf("Unexpected message advanced twice to %q", d.Queue)
+	}
+
+	if s, _ := redelivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+	// The original delivery was lost with its channel
+	if s, _ := delivery.Settlement(10 * time.Millisecond); s != broker.Unsettled {
+		t.Errorf("Unexpected original settlement. Have %q, want %q.",
+			s, broker.Unsettled)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	ge "github.com/SebastiaanPasterkamp/gonyexpress"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
@@ -20,20 +23,39 @@ func main() {
 	qname := flag.String(
 		"queue", "TestQueue", "Name of the AMQP queue to write to.",
 	)
+	metrics := flag.String(
+		"metrics", "", "Address to serve Prometheus /metrics on, e.g. ':9090'.",
+	)
+	health := flag.String(
+		"health", "", "Address to serve /healthz and /readyz on, e.g. ':8080'.",
+	)
+	drain := flag.Duration(
+		"drain", ge.DefaultDrainTimeout, "Time to finish messages in flight on shutdown.",
+	)
 	flag.Parse()
 
-	forever := make(chan bool)
-
 	c := ge.NewConsumer(*rmq, *qname, 4, operation)
-	err := c.Run()
-	if err != nil {
-		log.Printf("Failed to launch component: %+v\n", err)
-		close(forever)
-		c.Shutdown()
+	c.DrainTimeout = *drain
+	if *metrics != "" {
+		var err error
+		c.Metrics, err = ge.NewMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("Failed to register metrics: %+v\n", err)
+		}
+		go func() {
+			log.Fatal(ge.ListenAndServeMetrics(*metrics, prometheus.DefaultGatherer))
+		}()
 	}
-	defer c.Shutdown()
 
-	<-forever
+	if *health != "" {
+		go func() {
+			log.Fatal(c.ListenAndServeHealth(*health))
+		}()
+	}
+
+	if err := c.Serve(context.Background()); err != nil {
+		log.Fatalf("Failed to launch component: %+v\n", err)
+	}
 }
 
 func operation(
@@ -2,8 +2,10 @@ package main
 
 import (
 	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -19,11 +21,34 @@ func main() {
 	total := flag.Int(
 		"total", 1, "Number of messages to send1.",
 	)
+	path := flag.String(
+		"routes", "routes", "Route definition file, or directory of files.",
+	)
+	name := flag.String(
+		"route", "demo", "Name of the route to send the messages along.",
+	)
+	wait := flag.Duration(
+		"wait", 0, "Time to wait for the result of every message, if any.",
+	)
 	flag.Parse()
 
-	p := ge.NewProducer(*rmq, "")
+	routes, err := payload.LoadRoutes(*path)
+	if err != nil {
+		log.Fatalf("Failed to load routes: %+v\n", err)
+	}
+
+	route, err := routes.Route(*name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	qname := ""
+	if *wait > 0 {
+		qname = broker.AMQPReplyTo
+	}
+	p := ge.NewProducer(*rmq, qname)
 
-	_, err := p.Connect()
+	_, err = p.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -31,24 +56,7 @@ func main() {
 
 	for i := 0; i < *total; i++ {
 		msg := payload.NewMessage(
-			payload.Routing{
-				Name:     "demo",
-				Position: 0,
-				Slip: []payload.Step{
-					{
-						Queue: "foo",
-						Arguments: payload.Arguments{
-							"duration": "1s",
-						},
-					},
-					{
-						Queue: "bar",
-						Arguments: payload.Arguments{
-							"duration": "2s",
-						},
-					},
-				},
-			},
+			route,
 			payload.MetaData{
 				"origin": "producer",
 			},
@@ -61,6 +69,17 @@ func main() {
 			},
 		)
 
+		if *wait > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), *wait)
+			reply, err := p.Call(ctx, msg)
+			cancel()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%s: Received %+v\n", msg.TraceID, reply)
+			continue
+		}
+
 		err := p.SendMessage(msg)
 		if err != nil {
 			log.Fatal(err)
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayResetAndPosition(t *testing.T) {
+	type testCase struct {
+		position int
+		reset    bool
+
+		expectedPosition int
+		expectedAttempts []int
+	}
+
+	for name, tc := range map[string]testCase{
+		"as is":    {-1, false, 1, []int{1, 3}},
+		"reset":    {-1, true, 1, []int{1, 0}},
+		"position": {0, false, 0, []int{1, 3}},
+		"both":     {0, true, 0, []int{1, 0}},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			b := broker.NewMockBroker()
+			msgs, _ := b.Connect(0)
+			defer b.Close()
+
+			msg := payload.NewMessage(
+				payload.Routing{
+					Name:     "test-replay",
+					Position: 1,
+					Slip: []payload.Step{
+						{
+							Queue:         "first",
+							ErrorHandling: payload.ErrorHandling{MaxRetries: 3, Attempt: 1},
+						},
+						{
+							Queue:         "failed",
+							ErrorHandling: payload.ErrorHandling{MaxRetries: 3, Attempt: 3},
+						},
+					},
+				},
+				payload.MetaData{},
+				payload.Documents{},
+			).DeadLetter(fmt.Errorf("example"))
+
+			if _, err := b.DeliverMessage(msg); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			if !replay(b, <-msgs, filter{}, tc.position, tc.reset, false) {
+				t.Fatalf("Expected message to be replayed")
+			}
+
+			replayed, err := b.TakeMessage(time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if replayed.Routing.Position != tc.expectedPosition {
+				t.Errorf("Unexpected position. Have %d, want %d.",
+					replayed.Routing.Position, tc.expectedPosition)
+			}
+			for i, attempt := range tc.expectedAttempts {
+				if replayed.Routing.Slip[i].Attempt != attempt {
+					t.Errorf("Unexpected attempt at step %d. Have %d, want %d.",
+						i, replayed.Routing.Slip[i].Attempt, attempt)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayCompensated(t *testing.T) {
+	type testCase struct {
+		position int
+		replayed bool
+	}
+
+	for name, tc := range map[string]testCase{
+		"failed step": {-1, false},
+		"other step":  {1, false},
+		"restart":     {0, true},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			b := broker.NewMockBroker()
+			msgs, _ := b.Connect(0)
+			defer b.Close()
+
+			msg := payload.NewMessage(
+				payload.Routing{
+					Name:     "test-replay",
+					Position: 2,
+					Slip: []payload.Step{
+						{Queue: "reserve", Compensate: "release"},
+						{Queue: "charge", Compensate: "refund"},
+						{Queue: "ship"},
+					},
+				},
+				payload.MetaData{},
+				payload.Documents{},
+			).DeadLetter(fmt.Errorf("example"))
+			msg.MetaData[payload.Compensated] = true
+
+			if _, err := b.DeliverMessage(msg); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			if replayed := replay(b, <-msgs, filter{}, tc.position, false, false); replayed != tc.replayed {
+				t.Fatalf("Unexpected replay. Have %v, want %v.", replayed, tc.replayed)
+			}
+			if !tc.replayed {
+				return
+			}
+
+			replayed, err := b.TakeMessage(time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if replayed.Routing.Position != 0 {
+				t.Errorf("Unexpected position. Have %d, want %d.",
+					replayed.Routing.Position, 0)
+			}
+			if _, ok := replayed.MetaData[payload.Compensated]; ok {
+				t.Errorf("Unexpected %q metadata in %+v.",
+					payload.Compensated, replayed.MetaData)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	since := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)
+
+	type testCase struct {
+		filter filter
+		route  string
+		trace  string
+		at     interface{}
+
+		expected bool
+	}
+
+	at := func(t time.Time) string { return t.Format(time.RFC3339Nano) }
+
+	for name, tc := range map[string]testCase{
+		"no filter":         {filter{}, "demo", "abc", nil, true},
+		"route":             {filter{route: "demo"}, "demo", "abc", nil, true},
+		"other route":       {filter{route: "demo"}, "other", "abc", nil, false},
+		"trace":             {filter{trace: "abc"}, "demo", "abc", nil, true},
+		"other trace":       {filter{trace: "abc"}, "demo", "def", nil, false},
+		"since start":       {filter{since: since}, "demo", "abc", at(since), true},
+		"before since":      {filter{since: since}, "demo", "abc", at(since.Add(-time.Nanosecond)), false},
+		"before until":      {filter{until: until}, "demo", "abc", at(until.Add(-time.Nanosecond)), true},
+		"until end":         {filter{until: until}, "demo", "abc", at(until), false},
+		"within range":      {filter{since: since, until: until}, "demo", "abc", at(since.Add(time.Hour)), true},
+		"after range":       {filter{since: since, until: until}, "demo", "abc", at(until.Add(time.Hour)), false},
+		"missing time":      {filter{since: since}, "demo", "abc", nil, false},
+		"invalid time":      {filter{until: until}, "demo", "abc", "yesterday", false},
+		"non-string time":   {filter{since: since}, "demo", "abc", 1622505600, false},
+		"route and range":   {filter{route: "demo", since: since}, "demo", "abc", at(since), true},
+		"route not matched": {filter{route: "demo", since: since}, "other", "abc", at(since), false},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			msg := &payload.Message{
+				Routing:  payload.Routing{Name: tc.route},
+				TraceID:  tc.trace,
+				MetaData: payload.MetaData{},
+			}
+			if tc.at != nil {
+				msg.MetaData[payload.DeadLetterTime] = tc.at
+			}
+
+			if match := tc.filter.match(msg); match != tc.expected {
+				t.Errorf("Unexpected match. Have %v, want %v.", match, tc.expected)
+			}
+		})
+	}
+}
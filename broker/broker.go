@@ -4,16 +4,20 @@ import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
 	"strings"
-
-	"github.com/streadway/amqp"
+	"time"
 )
 
 // Broker is an interface defining the bare functionality of a RabbitMQ
-// connection.
+// connection. Messages are received as Delivery, so no transport specific
+// types leak out of a Broker implementation.
 type Broker interface {
-	Connect(prefetch int) (<-chan amqp.Delivery, error)
+	Connect(prefetch int) (<-chan Delivery, error)
 	Close()
 	SendMessage(msg payload.Message) error
+	SendDelayedMessage(msg payload.Message, delay time.Duration) error
+	Publish(queue string, body []byte, headers map[string]interface{}) error
+	Connected() bool
+	Cancel() error
 }
 
 // New creates either a RabbitMQ instance (default), or a MockBroker instance,
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNotConfirmed is returned by SendMessage when the RabbitMQ instance
+// negatively acknowledged a published message.
+var ErrNotConfirmed = errors.New("message was not confirmed by RabbitMQ")
+
+// confirms tracks the publisher confirms outstanding on a single channel. The
+// delivery tags are assigned by the channel in publishing order, starting at 1.
+type confirms struct {
+	// publishing serializes publishes, so their tags follow the channel. It is
+	// never taken while holding mu, nor by the goroutine handling confirms, as
+	// publishing may block until pending confirms are handled.
+	publishing sync.Mutex
+	// mu guards the fields below
+	mu      sync.Mutex
+	tag     uint64
+	pending map[uint64]*pending
+	ids     map[string]uint64
+	closed  bool
+}
+
+// pending is a published message awaiting its publisher confirm.
+type pending struct {
+	id        string
+	confirmed chan error
+	// err is set when the message is returned before being confirmed
+	err error
+}
+
+func newConfirms() *confirms {
+	return &confirms{
+		pending: map[uint64]*pending{},
+		ids:     map[string]uint64{},
+	}
+}
+
+// publish registers the next delivery tag under the message id, and calls send.
+// The returned channel receives the outcome once confirmed.
+func (c *confirms) publish(id string, send func() error) (<-chan error, error) {
+	c.publishing.Lock()
+	defer c.publishing.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	c.tag++
+	tag := c.tag
+	p := &pending{
+		id:        id,
+		confirmed: make(chan error, 1),
+	}
+	c.pending[tag] = p
+	c.ids[id] = tag
+	c.mu.Unlock()
+
+	// The confirm may already be handled before send returns
+	if err := send(); err != nil {
+		c.mu.Lock()
+		// The channel only assigns a tag to sent messages
+		c.tag--
+		delete(c.pending, tag)
+		delete(c.ids, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return p.confirmed, nil
+}
+
+// returned marks the message by id as failed. RabbitMQ sends a return before
+// the confirm of the same message, so the error is reported upon confirm.
+func (c *confirms) returned(id string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if tag, ok := c.ids[id]; ok {
+		c.pending[tag].err = err
+	}
+}
+
+// hold takes the message by id out of the pending confirms, for the caller to
+// report its outcome on the returned channel instead. Returns nil for unknown
+// messages.
+func (c *confirms) hold(id string) chan<- error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tag, ok := c.ids[id]
+	if !ok {
+		return nil
+	}
+	p := c.pending[tag]
+	delete(c.pending, tag)
+	delete(c.ids, id)
+	return p.confirmed
+}
+
+// confirm resolves the pending message by delivery tag.
+func (c *confirms) confirm(conf amqp.Confirmation) {
+	c.mu.Lock()
+	p, ok := c.pending[conf.DeliveryTag]
+	if ok {
+		delete(c.pending, conf.DeliveryTag)
+		delete(c.ids, p.id)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch {
+	case p.err != nil:
+		p.confirmed <- p.err
+	case !conf.Ack:
+		p.confirmed <- ErrNotConfirmed
+	default:
+		p.confirmed <- nil
+	}
+}
+
+// close fails all messages still awaiting a confirm, as the channel closed.
+func (c *confirms) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for tag, p := range c.pending {
+		p.confirmed <- amqp.ErrClosed
+		delete(c.pending, tag)
+		delete(c.ids, p.id)
+	}
+}
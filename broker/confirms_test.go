@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirms(t *testing.T) {
+	type event func(c *confirms)
+
+	confirm := func(tag uint64, ack bool) event {
+		return func(c *confirms) {
+			c.confirm(amqp.Confirmation{DeliveryTag: tag, Ack: ack})
+		}
+	}
+	returned := func(id string) event {
+		return func(c *confirms) {
+			c.returned(id, ErrUnroutable)
+		}
+	}
+	closed := func(c *confirms) {
+		c.close()
+	}
+
+	type testCase struct {
+		events   []event
+		expected map[string]error
+	}
+
+	for name, tc := range map[string]testCase{
+		"acked": {
+			events:   []event{confirm(1, true), confirm(2, true)},
+			expected: map[string]error{"a": nil, "b": nil},
+		},
+		"out of order": {
+			events:   []event{confirm(2, true), confirm(1, false)},
+			expected: map[string]error{"a": ErrNotConfirmed, "b": nil},
+		},
+		"nacked": {
+			events:   []event{confirm(1, false), confirm(2, true)},
+			expected: map[string]error{"a": ErrNotConfirmed, "b": nil},
+		},
+		"returned before confirm": {
+			events:   []event{returned("b"), confirm(1, true), confirm(2, true)},
+			expected: map[string]error{"a": nil, "b": ErrUnroutable},
+		},
+		"returned unknown": {
+			events:   []event{returned("c"), confirm(1, true), confirm(2, true)},
+			expected: map[string]error{"a": nil, "b": nil},
+		},
+		"closed": {
+			events:   []event{confirm(1, true), closed},
+			expected: map[string]error{"a": nil, "b": amqp.ErrClosed},
+		},
+		"confirmed after close": {
+			events:   []event{closed, confirm(1, true)},
+			expected: map[string]error{"a": amqp.ErrClosed, "b": amqp.ErrClosed},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			c := newConfirms()
+
+			outcomes := map[string]<-chan error{}
+			for _, id := range []string{"a", "b"} {
+				confirmed, err := c.publish(id, func() error { return nil })
+				if err != nil {
+					t.Fatalf("Unexpected error: %+v", err)
+				}
+				outcomes[id] = confirmed
+			}
+
+			for _, e := range tc.events {
+				e(c)
+			}
+
+			for id, want := range tc.expected {
+				select {
+				case have := <-outcomes[id]:
+					if !errors.Is(have, want) {
+						t.Errorf("Unexpected outcome of %q. Have %v, want %v.",
+							id, have, want)
+					}
+				default:
+					t.Errorf("Expected an outcome of %q, got none", id)
+				}
+			}
+
+			if len(c.pending) != 0 || len(c.ids) != 0 {
+				t.Errorf("Unexpected pending confirms: %+v", c.pending)
+			}
+		})
+	}
+}
+
+func TestConfirmsPublish(t *testing.T) {
+	type testCase struct {
+		closed bool
+		send   error
+
+		expected error
+		tag      uint64
+	}
+
+	failed := fmt.Errorf("send failed")
+
+	for name, tc := range map[string]testCase{
+		"sent":        {expected: nil, tag: 1},
+		"send failed": {send: failed, expected: failed, tag: 0},
+		"after close": {closed: true, expected: amqp.ErrClosed, tag: 0},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			c := newConfirms()
+			if tc.closed {
+				c.close()
+			}
+
+			sent := false
+			confirmed, err := c.publish("a", func() error {
+				sent = true
+				return tc.send
+			})
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("Unexpected error. Have %v, want %v.", err, tc.expected)
+			}
+			if sent == tc.closed {
+				t.Errorf("Unexpected send. Have %v, want %v.", sent, !tc.closed)
+			}
+			if (confirmed != nil) != (tc.expected == nil) {
+				t.Errorf("Unexpected confirmed channel: %v", confirmed)
+			}
+			if c.tag != tc.tag {
+				t.Errorf("Unexpected delivery tag. Have %d, want %d.", c.tag, tc.tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package broker
+
+// Delivery is a single message received through a Broker. Every Delivery must
+// be settled exactly once, by calling either Ack, Nack, or Reject.
+type Delivery interface {
+	// Body returns the raw message body
+	Body() []byte
+	// Headers returns the transport headers of the message, if any
+	Headers() map[string]interface{}
+	// CorrelationID returns the id correlating the message, i.e. the TraceID
+	CorrelationID() string
+	// Redelivered tells if the message was delivered before, but not acked
+	Redelivered() bool
+	// ReplyTo returns the Direct Reply-To queue of the producer, if any
+	ReplyTo() string
+	// Ack acknowledges the message was handled
+	Ack() error
+	// Nack negatively acknowledges the message, optionally requeueing it
+	Nack(requeue bool) error
+	// Reject refuses the message, optionally requeueing it
+	Reject(requeue bool) error
+}
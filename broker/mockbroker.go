@@ -6,71 +6,314 @@ import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
 	"encoding/json"
+	"fmt"
+	"sync"
 
 	"github.com/streadway/amqp"
 )
 
+// MockReplyTo is the Direct Reply-To queue the MockBroker assigns to messages
+// with an AMQPReplyTo step.
+const MockReplyTo = AMQPReplyTo + ".mock"
+
 // MockBroker is a Mock Broker implementation which can be used in tests.
 type MockBroker struct {
-	inc chan amqp.Delivery
-	out chan amqp.Delivery
+	inc chan Delivery
+	out chan *MockDelivery
+
+	mu        sync.Mutex
+	connected bool
+	cancelled bool
+
+	// outMu guards sending on out against Close
+	outMu  sync.RWMutex
+	closed bool
 }
 
 // NewMockBroker creates a Mock Broker instance ready for testing.
 func NewMockBroker() *MockBroker {
 	return &MockBroker{
-		inc: make(chan amqp.Delivery, 10),
-		out: make(chan amqp.Delivery, 10),
+		inc: make(chan Delivery, 10),
+		out: make(chan *MockDelivery, 10),
 	}
 }
 
 // Connect only serves to complete the Broker interface. It returns the mock
 // message channel
-func (m *MockBroker) Connect(_ int) (<-chan amqp.Delivery, error) {
+func (m *MockBroker) Connect(_ int) (<-chan Delivery, error) {
+	m.SetConnected(true)
 	return m.inc, nil
 }
 
 // Close closes the test queue.
 func (m *MockBroker) Close() {
-	close(m.inc)
-	close(m.out)
+	m.SetConnected(false)
+	m.Cancel()
+
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.out)
+	}
 }
 
-// SendMessage sends a message onto the outgoing queue
-func (m *MockBroker) SendMessage(msg payload.Message) error {
-	m.addMessageToQueue(m.out, msg)
+// send puts the delivery onto the outgoing queue, or fails if the MockBroker
+// is closed.
+func (m *MockBroker) send(d *MockDelivery) error {
+	m.outMu.RLock()
+	defer m.outMu.RUnlock()
+
+	if m.closed {
+		return amqp.ErrClosed
+	}
+	m.out <- d
+	return nil
+}
+
+// Cancel closes the incoming queue, so no more messages can be delivered.
+func (m *MockBroker) Cancel() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.cancelled {
+		m.cancelled = true
+		close(m.inc)
+	}
 	return nil
 }
 
-// DeliverMessage puts a message onto the incoming queue
-func (m *MockBroker) DeliverMessage(msg payload.Message) {
-	m.addMessageToQueue(m.inc, msg)
+// Connected tells if the MockBroker is connected, i.e. between Connect and
+// Close, unless overridden by SetConnected.
+func (m *MockBroker) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connected
 }
 
-func (m *MockBroker) addMessageToQueue(q chan amqp.Delivery, msg payload.Message) error {
-	body, err := json.Marshal(msg)
+// SetConnected overrides the connection state, e.g. to simulate a lost
+// connection.
+func (m *MockBroker) SetConnected(connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = connected
+}
+
+// SendMessage sends a message onto the outgoing queue
+func (m *MockBroker) SendMessage(msg payload.Message) error {
+	d, err := newMockDelivery(msg)
+	if err != nil {
+		return err
+	}
+
+	return m.send(d)
+}
+
+// SendDelayedMessage sends a message onto the outgoing queue immediately, but
+// records the delay on the MockDelivery.
+func (m *MockBroker) SendDelayedMessage(msg payload.Message, delay time.Duration) error {
+	d, err := newMockDelivery(msg)
 	if err != nil {
 		return err
 	}
 
-	q <- amqp.Delivery{
-		// Properties
-		ContentType:   "application/json",
-		CorrelationId: msg.TraceID,
-		DeliveryMode:  amqp.Persistent,
-		Body:          body,
+	d.Delay = delay
+	return m.send(d)
+}
+
+// Publish sends a raw body onto the outgoing queue, recording the queue name
+// and headers on the MockDelivery.
+func (m *MockBroker) Publish(queue string, body []byte, headers map[string]interface{}) error {
+	if headers == nil {
+		headers = map[string]interface{}{}
 	}
 
-	return nil
+	return m.send(&MockDelivery{
+		Queue:   queue,
+		body:    body,
+		headers: headers,
+		settled: make(chan struct{}),
+	})
+}
+
+// DeliverMessage puts a message onto the incoming queue. The returned
+// MockDelivery records how the consumer settles it.
+func (m *MockBroker) DeliverMessage(msg payload.Message) (*MockDelivery, error) {
+	d, err := newMockDelivery(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	m.inc <- d
+	return d, nil
+}
+
+// DeliverBody puts a raw body onto the incoming queue, e.g. to deliver a
+// malformed message. The returned MockDelivery records how it is settled.
+func (m *MockBroker) DeliverBody(body []byte) *MockDelivery {
+	d := &MockDelivery{
+		body:    body,
+		headers: map[string]interface{}{},
+		settled: make(chan struct{}),
+	}
+
+	m.inc <- d
+	return d
+}
+
+// Deliver puts a copy of a delivery, e.g. one taken from the outgoing queue,
+// onto the incoming queue. The returned MockDelivery records how it is settled.
+func (m *MockBroker) Deliver(d *MockDelivery) *MockDelivery {
+	c := &MockDelivery{
+		Queue:         d.Queue,
+		body:          d.body,
+		headers:       d.headers,
+		correlationID: d.correlationID,
+		replyTo:       d.replyTo,
+		settled:       make(chan struct{}),
+	}
+
+	m.inc <- c
+	return c
 }
 
 // TakeMessage pops a message from the outgoing queue, of one is available. Does
 // not block.
 func (m *MockBroker) TakeMessage(d time.Duration) (*payload.Message, error) {
+	delivery := m.TakeDelivery(d)
+	if delivery == nil {
+		return nil, nil
+	}
+	return payload.MessageFromByteSlice(delivery.Body())
+}
+
+// TakeDelivery pops a delivery from the outgoing queue, waiting up to the
+// duration for one to become available. Returns nil if there is none.
+func (m *MockBroker) TakeDelivery(d time.Duration) *MockDelivery {
 	select {
-	case d := <-m.out:
-		return payload.MessageFromByteSlice(d.Body)
+	case delivery := <-m.out:
+		return delivery
 	case <-time.After(d):
-		return nil, nil
+		return nil
+	}
+}
+
+// Settlement describes how a Delivery was settled.
+type Settlement string
+
+const (
+	// Unsettled means the Delivery was not (yet) settled
+	Unsettled Settlement = ""
+	// Acked means the Delivery was acknowledged
+	Acked Settlement = "ack"
+	// Nacked means the Delivery was negatively acknowledged
+	Nacked Settlement = "nack"
+	// Rejected means the Delivery was rejected
+	Rejected Settlement = "reject"
+)
+
+// MockDelivery is a Delivery passing through the MockBroker. It records how it
+// is settled, so tests can verify the behaviour of a consumer.
+type MockDelivery struct {
+	// Queue is the name of the queue the message was sent to
+	Queue string
+	// Delay is the delay with which the message was sent, if any
+	Delay         time.Duration
+	body          []byte
+	headers       map[string]interface{}
+	correlationID string
+	redelivered   bool
+	// replyTo is set for a message with an AMQPReplyTo step, as RabbitMQ would
+	replyTo string
+
+	mu         sync.Mutex
+	settlement Settlement
+	requeue    bool
+	settled    chan struct{}
+}
+
+func newMockDelivery(msg payload.Message) (*MockDelivery, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &MockDelivery{
+		body:          body,
+		headers:       map[string]interface{}{},
+		correlationID: msg.TraceID,
+		settled:       make(chan struct{}),
+	}
+	if step, err := msg.CurrentStep(); err == nil {
+		d.Queue = step.Queue
+	}
+	if HasReplyTo(msg) {
+		d.replyTo = MockReplyTo
 	}
+	return d, nil
+}
+
+// Body returns the raw message body
+func (d *MockDelivery) Body() []byte {
+	return d.body
+}
+
+// Headers returns the headers of the message
+func (d *MockDelivery) Headers() map[string]interface{} {
+	return d.headers
+}
+
+// CorrelationID returns the TraceID of the message
+func (d *MockDelivery) CorrelationID() string {
+	return d.correlationID
+}
+
+// Redelivered tells if the message was delivered before
+func (d *MockDelivery) Redelivered() bool {
+	return d.redelivered
+}
+
+// ReplyTo returns the Direct Reply-To queue of the producer, if any
+func (d *MockDelivery) ReplyTo() string {
+	return d.replyTo
+}
+
+// Ack records the message as acknowledged
+func (d *MockDelivery) Ack() error {
+	return d.settle(Acked, false)
+}
+
+// Nack records the message as negatively acknowledged
+func (d *MockDelivery) Nack(requeue bool) error {
+	return d.settle(Nacked, requeue)
+}
+
+// Reject records the message as rejected
+func (d *MockDelivery) Reject(requeue bool) error {
+	return d.settle(Rejected, requeue)
+}
+
+func (d *MockDelivery) settle(s Settlement, requeue bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.settlement != Unsettled {
+		return fmt.Errorf("delivery already settled as %q", d.settlement)
+	}
+	d.settlement, d.requeue = s, requeue
+	close(d.settled)
+	return nil
+}
+
+// Settlement waits up to the duration for the delivery to be settled, and
+// returns how it was settled, and whether it was requeued.
+func (d *MockDelivery) Settlement(timeout time.Duration) (Settlement, bool) {
+	select {
+	case <-d.settled:
+	case <-time.After(timeout):
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.settlement, d.requeue
 }
@@ -1,10 +1,18 @@
 package broker
 
 import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
@@ -12,112 +20,749 @@ import (
 // request progress or result messages.
 const AMQPReplyTo = "amq.rabbitmq.reply-to"
 
+// HasReplyTo tells if the Slip of the message has a step for AMQPReplyTo, or
+// if AMQPReplyTo is the ProgressQueue, which is still to be resolved to the
+// Direct Reply-To queue of the producer.
+func HasReplyTo(msg payload.Message) bool {
+	if msg.MetaData[payload.ProgressQueue] == AMQPReplyTo {
+		return true
+	}
+	for _, step := range msg.Routing.Slip {
+		if step.Queue == AMQPReplyTo {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveReplyTo replaces AMQPReplyTo in the queue of the steps in the Slip,
+// and the ProgressQueue, of the message with the Direct Reply-To queue of the
+// producer. The message is modified in place.
+func ResolveReplyTo(msg *payload.Message, replyTo string) {
+	for i := range msg.Routing.Slip {
+		if msg.Routing.Slip[i].Queue == AMQPReplyTo {
+			msg.Routing.Slip[i].Queue = replyTo
+		}
+	}
+	if msg.MetaData[payload.ProgressQueue] == AMQPReplyTo {
+		msg.MetaData[payload.ProgressQueue] = replyTo
+	}
+}
+
+// isReplyTo tells if the queue is a Direct Reply-To queue, which can't be
+// declared.
+func isReplyTo(queue string) bool {
+	return strings.HasPrefix(queue, AMQPReplyTo)
+}
+
+const (
+	// DefaultReconnectDelay is the initial delay before reconnecting after the
+	// RabbitMQ connection or channel is lost.
+	DefaultReconnectDelay = 1 * time.Second
+	// DefaultMaxReconnectDelay is the upper limit of the reconnect backoff.
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
+// delayPrecision is the granularity of delays, limiting the number of delay
+// queues needed for jittered delays.
+const delayPrecision = 100 * time.Millisecond
+
+// delayQueueExpiry is how long an unused delay queue lingers after its last
+// message expired.
+const delayQueueExpiry = 1 * time.Minute
+
+// maxTTL is the longest message TTL and queue expiry RabbitMQ accepts, in
+// milliseconds. Longer ones fail the declare, closing the channel.
+const maxTTL = math.MaxUint32
+
+// ErrUnroutable is returned by SendMessage when the message could not be routed
+// to any queue.
+var ErrUnroutable = errors.New("message is unroutable")
+
 // RabbitMQ is a RabbitMQ Broker implementation which can be used by consumers,
 // and producers alike.
 type RabbitMQ struct {
 	// URI of the RabbitMQ instance
 	URI string
+	// ReconnectDelay is the initial delay before reconnecting. The delay is
+	// doubled after every failed attempt, up to MaxReconnectDelay.
+	ReconnectDelay time.Duration
+	// MaxReconnectDelay is the upper limit of the delay between reconnects.
+	MaxReconnectDelay time.Duration
+	// Undeliverable is an optional queue to which unroutable messages are
+	// sent. Without it, unroutable messages are dropped, and reported by
+	// SendMessage as ErrUnroutable.
+	Undeliverable string
+	// Logger receives the log lines of the Broker. Without one, logger.Default
+	// is used.
+	Logger logger.Logger
 	// Name of the RabbitMQ Queue to subscribe to
 	qname string
-	// conn is the active connection to the RabbitMQ service
-	conn *amqp.Connection
+	// prefetch is the Qos prefetch count, re-applied after every reconnect
+	prefetch int
+	// mu guards the session, which is replaced on reconnect
+	mu sync.RWMutex
+	// sess is the active connection and channel to the RabbitMQ service
+	sess *session
+	// declared holds the names of queues declared by Publish
+	declared sync.Map
+	// deliveries is the channel handed out by Connect. It survives reconnects
+	// and is only closed after Close is called.
+	deliveries chan Delivery
+	// done is closed by Close to stop the reconnect supervisor
+	done chan struct{}
+	// tag identifies the consumer, to cancel it
+	tag string
+	// cancelled is set by Cancel, after which the queue is no longer consumed
+	cancelled bool
+	// dial opens a connection to the URI, replaced in tests
+	dial func(uri string) (connection, error)
+}
+
+// connection is the part of an AMQP connection used by a session.
+type connection interface {
+	Channel() (channel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// channel is the part of an AMQP channel used by a session.
+type channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Cancel(consumer string, noWait bool) error
+	Close() error
+}
+
+// amqpConnection is a connection to a RabbitMQ instance.
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func dial(uri string) (connection, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// Channel opens a new channel on the connection.
+func (c amqpConnection) Channel() (channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// session is a single connection + channel lifetime. Any of the notification
+// channels firing means the session is lost.
+type session struct {
+	// conn is the connection to the RabbitMQ service
+	conn connection
 	// ch is the RabbitMQ channel by which Messages are sent
-	ch *amqp.Channel
+	ch channel
+	// confirms tracks outstanding publisher confirms on ch
+	confirms   *confirms
+	msgs       <-chan amqp.Delivery
+	connClosed chan *amqp.Error
+	chClosed   chan *amqp.Error
 }
 
 // NewRabbitMQ creates a RabbitMQ instance ready to connect.
 func NewRabbitMQ(URI, qname string) *RabbitMQ {
 	return &RabbitMQ{
-		URI:   URI,
-		qname: qname,
+		URI:               URI,
+		ReconnectDelay:    DefaultReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+		qname:             qname,
+		tag:               "gonyexpress-" + uuid.New().String(),
+		dial:              dial,
 	}
 }
 
 // Connect opens up a RabbitMQ connection and returns a channel through which
-// Messages are delivered.
-func (r *RabbitMQ) Connect(prefetch int) (<-chan amqp.Delivery, error) {
-	var err error
-	r.conn, err = amqp.Dial(r.URI)
+// Messages are delivered. A lost connection or channel is re-established in
+// the background, after which deliveries resume on the same channel.
+func (r *RabbitMQ) Connect(prefetch int) (<-chan Delivery, error) {
+	r.prefetch = prefetch
+
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.done = done
+	r.mu.Unlock()
+
+	s, err := r.setup(done)
 	if err != nil {
 		return nil, err
 	}
 
-	r.ch, err = r.conn.Channel()
+	if r.qname != "" {
+		r.deliveries = make(chan Delivery)
+	}
+	go r.supervise(done, s)
+
+	return r.deliveries, nil
+}
+
+// setup dials RabbitMQ and opens a channel ready for publishing and, if a
+// queue is set, consuming.
+func (r *RabbitMQ) setup(done <-chan struct{}) (*session, error) {
+	conn, err := r.dial(r.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := r.open(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	err = r.ch.Qos(
-		prefetch, // prefetch count
-		0,        // prefetch size
-		false,    // global
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-done:
+		conn.Close()
+		return nil, fmt.Errorf("connection closed during setup")
+	default:
+	}
+
+	r.sess = s
+	if r.cancelled && s.msgs != nil {
+		// Cancel was called while opening the session
+		if err := s.ch.Cancel(r.tag, false); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// open creates a channel on the connection, applies the Qos, and declares and
+// consumes the queue, if any.
+func (r *RabbitMQ) open(conn connection) (*session, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Qos(
+		r.prefetch, // prefetch count
+		0,          // prefetch size
+		false,      // global
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.qname == "" {
-		// Producer-only mode
-		return nil, nil
+	s := &session{
+		conn:       conn,
+		ch:         ch,
+		connClosed: conn.NotifyClose(make(chan *amqp.Error, 1)),
+		chClosed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	s.confirms = newConfirms()
+	confirmations := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	// Unbuffered, so a return is handled before the confirm that follows it
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	go r.listen(s, confirmations, returns)
+
+	if r.Undeliverable != "" {
+		if err = declareAside(conn, r.Undeliverable); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.qname == "" || r.isCancelled() {
+		// Producer-only mode, or no longer consuming
+		return s, nil
 	}
 
 	// TODO: Queue definitions should happen outside
 	if r.qname != AMQPReplyTo {
-		_, err = r.ch.QueueDeclare(
-			r.qname, // name
-			true,    // durable
-			false,   // delete when unused
-			false,   // exclusive
-			false,   // no-wait
-			nil,     // arguments for plugins
-		)
-		if err != nil {
+		if err = declare(ch, r.qname); err != nil {
 			return nil, err
 		}
 	}
 
-	return r.ch.Consume(
+	// Direct Reply-To can only be consumed in auto ack mode
+	autoAck := r.qname == AMQPReplyTo
+
+	s.msgs, err = ch.Consume(
 		r.qname, // key
-		"",      // consumer
-		false,   // auto ack
+		r.tag,   // consumer
+		autoAck, // auto ack
 		false,   // exclusive
 		false,   // no local
 		false,   // no wait
 		nil,     // args for plugins
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// declare declares a durable queue by name.
+func declare(ch channel, qname string) error {
+	_, err := ch.QueueDeclare(
+		qname, // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments for plugins
+	)
+	return err
+}
+
+// declareAside declares a durable queue by name on a channel of its own, as a
+// queue declared before with other arguments fails, and closes, the channel.
+// Such a queue exists, so that is not an error.
+func declareAside(conn connection, qname string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = declare(ch, qname)
+	var aerr *amqp.Error
+	if errors.As(err, &aerr) && aerr.Code == amqp.PreconditionFailed {
+		return nil
+	}
+	return err
+}
+
+// supervise forwards deliveries of the current session, and reconnects when
+// the session is lost, until Close is called. The deliveries channel is closed
+// once the consumer is cancelled, and the remaining deliveries are forwarded.
+func (r *RabbitMQ) supervise(done <-chan struct{}, s *session) {
+	deliveries := r.deliveries
+	stop := func() {
+		if deliveries != nil {
+			close(deliveries)
+			deliveries = nil
+		}
+	}
+	defer stop()
+
+	msgs := s.msgs
+	for {
+		var err *amqp.Error
+
+		if msgs == nil {
+			stop()
+		}
+
+		select {
+		case <-done:
+			return
+
+		case d, ok := <-msgs:
+			if ok {
+				select {
+				case deliveries <- amqpDelivery{d}:
+				case <-done:
+					return
+				}
+				continue
+			}
+			if r.isCancelled() {
+				msgs = nil
+				continue
+			}
+			err = amqp.ErrClosed
+
+		case err = <-s.connClosed:
+		case err = <-s.chClosed:
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		r.log().Warnf("Lost RabbitMQ connection: %+v. Reconnecting...", err)
+		s.conn.Close()
+
+		if s = r.reconnect(done); s == nil {
+			return
+		}
+		msgs = s.msgs
+		r.log().Infof("Successfully reconnected to our RabbitMQ Instance")
+	}
+}
+
+// reconnect keeps trying to set up a new session with an exponential backoff.
+// Returns nil if Close is called in the meantime.
+func (r *RabbitMQ) reconnect(done <-chan struct{}) *session {
+	delay := r.ReconnectDelay
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		s, err := r.setup(done)
+		if err == nil {
+			return s
+		}
+		r.log().Warnf("Failed to reconnect to RabbitMQ: %+v. Retrying in %s...",
+			err, delay)
+
+		delay *= 2
+		if delay > r.MaxReconnectDelay {
+			delay = r.MaxReconnectDelay
+		}
+	}
+}
+
+// listen handles the returns and publisher confirms of a session in the order
+// in which they arrive, until the channel closes.
+func (r *RabbitMQ) listen(
+	s *session, confirmations <-chan amqp.Confirmation, returns <-chan amqp.Return,
+) {
+	for confirmations != nil || returns != nil {
+		select {
+		case conf, ok := <-confirmations:
+			if !ok {
+				confirmations = nil
+				s.confirms.close()
+				continue
+			}
+			s.confirms.confirm(conf)
+
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			r.undeliverable(s, ret)
+		}
+	}
+}
+
+// undeliverable handles a message returned as unroutable, by sending it to the
+// Undeliverable queue if configured, or failing the pending SendMessage.
+func (r *RabbitMQ) undeliverable(s *session, ret amqp.Return) {
+	err := fmt.Errorf("%w: no queue %q (%d %s)",
+		ErrUnroutable, ret.RoutingKey, ret.ReplyCode, ret.ReplyText)
+
+	if r.Undeliverable != "" && ret.RoutingKey != r.Undeliverable {
+		// Publishing may wait for the confirms handled by the caller, so the
+		// outcome of the pending SendMessage is only known later.
+		go r.park(s, ret, err, s.confirms.hold(ret.MessageId))
+		return
+	}
+
+	r.log().WithFields(logger.Fields{logger.TraceID: ret.CorrelationId}).
+		Errorf("Dropped unroutable message: %+v", err)
+	s.confirms.returned(ret.MessageId, err)
+}
+
+// park sends the returned message to the Undeliverable queue, and reports the
+// outcome to the held SendMessage, if any.
+func (r *RabbitMQ) park(s *session, ret amqp.Return, err error, outcome chan<- error) {
+	log := r.log().WithFields(logger.Fields{logger.TraceID: ret.CorrelationId})
+
+	headers := amqp.Table{}
+	for k, v := range ret.Headers {
+		headers[k] = v
+	}
+	headers["x-undeliverable-queue"] = ret.RoutingKey
+	headers["x-undeliverable-reason"] = ret.ReplyText
+
+	perr := r.publishOn(s, r.Undeliverable, amqp.Publishing{
+		Headers:       headers,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: ret.CorrelationId,
+		ContentType:   ret.ContentType,
+		Body:          ret.Body,
+	})
+	if perr == nil {
+		log.Warnf("Sent unroutable message to %q: %+v", r.Undeliverable, err)
+		err = nil
+	} else {
+		log.Errorf("Failed to send unroutable message to %q: %+v",
+			r.Undeliverable, perr)
+		log.Errorf("Dropped unroutable message: %+v", err)
+	}
+
+	if outcome != nil {
+		outcome <- err
+	}
 }
 
 // Close terminates the RabbitMQ channel and connection. Should be used when
 // running a Producer, after Connect is called. Automatically called after
 // Shutdown for a running Consumer.
 func (r *RabbitMQ) Close() {
-	if r.ch != nil {
-		r.ch.Close()
-		r.ch = nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
 	}
-	if r.conn != nil {
-		r.conn.Close()
-		r.conn = nil
+	if r.sess != nil {
+		r.sess.ch.Close()
+		r.sess.conn.Close()
+		r.sess = nil
 	}
 }
 
-// SendMessage sends a message onto the message's current Slip queue
+// SendMessage sends a message onto the message's current Slip queue. It blocks
+// until the message is confirmed. When consuming the AMQPReplyTo queue, a
+// message with an AMQPReplyTo step in the Slip is sent with the Direct Reply-To
+// property set.
 func (r *RabbitMQ) SendMessage(msg payload.Message) error {
 	body, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	return r.ch.Publish(
-		"", // exchange
-		msg.Routing.Slip[msg.Routing.Position].Queue, // routing key
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			DeliveryMode:  amqp.Persistent,
-			CorrelationId: msg.TraceID,
-			ContentType:   "application/json",
-			Body:          body,
+	p := amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.TraceID,
+		ContentType:   "application/json",
+		Body:          body,
+	}
+	if r.qname == AMQPReplyTo && HasReplyTo(msg) {
+		p.ReplyTo = AMQPReplyTo
+	}
+
+	return r.publish(msg.Routing.Slip[msg.Routing.Position].Queue, p)
+}
+
+// SendDelayedMessage sends a message onto the message's current Slip queue
+// after the delay. The message is parked on a delay queue, with a message TTL
+// of the delay, from which RabbitMQ dead-letters it into the Slip queue. Delays
+// beyond what RabbitMQ supports, about 49 days, are shortened to that.
+func (r *RabbitMQ) SendDelayedMessage(msg payload.Message, delay time.Duration) error {
+	delay = delay.Round(delayPrecision)
+	if delay <= 0 {
+		return r.SendMessage(msg)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	s := r.session()
+	if s == nil {
+		return amqp.ErrClosed
+	}
+
+	queue := msg.Routing.Slip[msg.Routing.Position].Queue
+	ttl := int64(delay / time.Millisecond)
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	expires := ttl + int64(delayQueueExpiry/time.Millisecond)
+	if expires > maxTTL {
+		expires = maxTTL
+	}
+	dqname := fmt.Sprintf("%s.delay.%dms", queue, ttl)
+
+	// Redeclared for every message, as only that renews the queue expiry
+	_, err = s.ch.QueueDeclare(
+		dqname, // name
+		true,   // durable
+		false,  // delete when unused
+		false,  // exclusive
+		false,  // no-wait
+		amqp.Table{
+			"x-message-ttl":             ttl,
+			"x-expires":                 expires,
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	return r.publishOn(s, dqname, amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.TraceID,
+		ContentType:   "application/json",
+		Body:          body,
+	})
+}
+
+// Publish sends a raw body, with optional headers, onto the named queue. The
+// queue is declared as durable on first use, unless it is a Direct Reply-To
+// queue or already declared with other arguments.
+func (r *RabbitMQ) Publish(queue string, body []byte, headers map[string]interface{}) error {
+	s := r.session()
+	if s == nil {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := r.declared.Load(queue); !ok && !isReplyTo(queue) {
+		if err := declareAside(s.conn, queue); err != nil {
+			return err
+		}
+		r.declared.Store(queue, true)
+	}
+
+	return r.publishOn(s, queue, amqp.Publishing{
+		Headers:      amqp.Table(headers),
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "application/json",
+		Body:         body,
+	})
+}
+
+// Cancel stops consuming the queue, also after reconnecting. Deliveries
+// already received are still passed on, after which the channel returned by
+// Connect is closed. Publishing remains possible until Close is called.
+func (r *RabbitMQ) Cancel() error {
+	r.mu.Lock()
+	if r.cancelled || r.qname == "" {
+		r.mu.Unlock()
+		return nil
+	}
+	r.cancelled = true
+	s := r.sess
+	r.mu.Unlock()
+
+	// A session set up in the meantime is cancelled by setup
+	if s == nil || s.msgs == nil {
+		return nil
+	}
+	return s.ch.Cancel(r.tag, false)
+}
+
+func (r *RabbitMQ) isCancelled() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cancelled
+}
+
+// Connected tells if the connection to the RabbitMQ instance is open. It is not
+// while reconnecting.
+func (r *RabbitMQ) Connected() bool {
+	s := r.session()
+	return s != nil && !s.conn.IsClosed()
+}
+
+// session returns the active session, or nil if not connected.
+func (r *RabbitMQ) session() *session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sess
+}
+
+// publish sends the publishing onto the queue using the active session, and
+// waits for the publisher confirm.
+func (r *RabbitMQ) publish(queue string, p amqp.Publishing) error {
+	s := r.session()
+	if s == nil {
+		return amqp.ErrClosed
+	}
+	return r.publishOn(s, queue, p)
+}
+
+// publishOn sends the publishing onto the queue using the session, and waits
+// for the publisher confirm.
+func (r *RabbitMQ) publishOn(s *session, queue string, p amqp.Publishing) error {
+	confirmed, err := s.publish(queue, p)
+	if err != nil {
+		return err
+	}
+	return <-confirmed
+}
+
+// publish sends the publishing onto the queue through the default exchange.
+// Messages are published as mandatory, so unroutable messages are returned,
+// except for Direct Reply-To queues. RabbitMQ returns those even when the reply
+// is delivered, as they are not real queues. The returned channel receives the
+// outcome once confirmed.
+func (s *session) publish(queue string, p amqp.Publishing) (<-chan error, error) {
+	p.MessageId = uuid.New().String()
+	mandatory := !isReplyTo(queue)
+
+	send := func() error {
+		return s.ch.Publish(
+			"",        // exchange
+			queue,     // routing key
+			mandatory, // mandatory
+			false,     // immediate
+			p,
+		)
+	}
+
+	return s.confirms.publish(p.MessageId, send)
+}
+
+// amqpDelivery is a Delivery received from RabbitMQ.
+type amqpDelivery struct {
+	d amqp.Delivery
+}
+
+// Body returns the raw message body
+func (a amqpDelivery) Body() []byte {
+	return a.d.Body
+}
+
+// Headers returns the AMQP headers of the message
+func (a amqpDelivery) Headers() map[string]interface{} {
+	return a.d.Headers
+}
+
+// CorrelationID returns the AMQP correlation id of the message
+func (a amqpDelivery) CorrelationID() string {
+	return a.d.CorrelationId
+}
+
+// Redelivered tells if RabbitMQ delivered the message before
+func (a amqpDelivery) Redelivered() bool {
+	return a.d.Redelivered
+}
+
+// ReplyTo returns the Direct Reply-To queue of the producer, if any
+func (a amqpDelivery) ReplyTo() string {
+	return a.d.ReplyTo
+}
+
+// Ack acknowledges the message was handled
+func (a amqpDelivery) Ack() error {
+	return a.d.Ack(false)
+}
+
+// Nack negatively acknowledges the message, optionally requeueing it
+func (a amqpDelivery) Nack(requeue bool) error {
+	return a.d.Nack(false, requeue)
+}
+
+// Reject refuses the message, optionally requeueing it
+func (a amqpDelivery) Reject(requeue bool) error {
+	return a.d.Reject(requeue)
+}
+
+// log returns the Logger of the Broker.
+func (r *RabbitMQ) log() logger.Logger {
+	if r.Logger == nil {
+		return logger.Default()
+	}
+	return r.Logger
 }
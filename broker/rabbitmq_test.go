@@ -0,0 +1,684 @@
+package broker
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// published is a message sent through a fakeChannel.
+type published struct {
+	key       string
+	mandatory bool
+	msg       amqp.Publishing
+}
+
+// fakeChannel records the messages published on it, and the queue it
+// consumes, which receives the messages passed to deliver.
+type fakeChannel struct {
+	mu        sync.Mutex
+	published []published
+	declared  map[string]amqp.Table
+	prefetch  int
+	consumed  string
+	msgs      chan amqp.Delivery
+	cancelled bool
+	conflicts map[string]bool
+}
+
+func (f *fakeChannel) Qos(prefetch, _ int, _ bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prefetch = prefetch
+	return nil
+}
+
+func (f *fakeChannel) Confirm(bool) error { return nil }
+
+func (f *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error { return c }
+
+func (f *fakeChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	return c
+}
+
+func (f *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return { return c }
+
+func (f *fakeChannel) Consume(
+	queue, _ string, _, _, _, _ bool, _ amqp.Table,
+) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consumed = queue
+	f.msgs = make(chan amqp.Delivery, 10)
+	return f.msgs, nil
+}
+
+func (f *fakeChannel) Publish(
+	_, key string, mandatory, _ bool, msg amqp.Publishing,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, published{key, mandatory, msg})
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclare(
+	name string, _, _, _, _ bool, args amqp.Table,
+) (amqp.Queue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conflicts[name] {
+		return amqp.Queue{}, &amqp.Error{
+			Code: amqp.PreconditionFailed, Reason: "inequivalent arg",
+		}
+	}
+	if f.declared == nil {
+		f.declared = map[string]amqp.Table{}
+	}
+	f.declared[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) Cancel(string, bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.cancelled && f.msgs != nil {
+		close(f.msgs)
+	}
+	f.cancelled = true
+	return nil
+}
+
+func (f *fakeChannel) Close() error { return nil }
+
+// deliver puts a message with the body on the consumed queue.
+func (f *fakeChannel) deliver(body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs <- amqp.Delivery{Body: []byte(body)}
+}
+
+// consuming returns the consumed queue, and the prefetch count.
+func (f *fakeChannel) consuming() (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.consumed, f.prefetch
+}
+
+// fakeConnection hands out its fakeChannel, and a new one for every further
+// channel opened, on which declaring the conflicting queues fails.
+type fakeConnection struct {
+	mu        sync.Mutex
+	ch        *fakeChannel
+	opened    bool
+	aside     []*fakeChannel
+	conflicts map[string]bool
+	failing   bool
+	notify    chan *amqp.Error
+	closed    bool
+}
+
+func (f *fakeConnection) Channel() (channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return nil, amqp.ErrClosed
+	}
+	if !f.opened {
+		f.opened = true
+		return f.ch, nil
+	}
+	ch := &fakeChannel{conflicts: f.conflicts}
+	f.aside = append(f.aside, ch)
+	return ch, nil
+}
+
+func (f *fakeConnection) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notify = c
+	return c
+}
+
+func (f *fakeConnection) IsClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeConnection) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// lose simulates the connection being lost.
+func (f *fakeConnection) lose() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notify <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "lost"}
+}
+
+// fakeDialer hands out a new fakeConnection for every dial, unless failing.
+type fakeDialer struct {
+	mu      sync.Mutex
+	conns   []*fakeConnection
+	failing bool
+}
+
+func (f *fakeDialer) dial(string) (connection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return nil, errors.New("connection refused")
+	}
+	conn := &fakeConnection{ch: &fakeChannel{}}
+	f.conns = append(f.conns, conn)
+	return conn, nil
+}
+
+// conn waits for the n-th connection to be dialed.
+func (f *fakeDialer) conn(t *testing.T, n int) *fakeConnection {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		if len(f.conns) > n {
+			conn := f.conns[n]
+			f.mu.Unlock()
+			return conn
+		}
+		f.mu.Unlock()
+	}
+	t.Fatalf("Expected connection %d to be dialed", n)
+	return nil
+}
+
+func (f *fakeDialer) fail(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+// receive takes the body of the next delivery.
+func receive(t *testing.T, deliveries <-chan Delivery) string {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatalf("Expected a delivery, but the channel closed")
+		}
+		return string(d.Body())
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a delivery, got none")
+	}
+	return ""
+}
+
+// closed waits for the deliveries channel to be closed.
+func closed(t *testing.T, deliveries <-chan Delivery) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-deliveries:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected the deliveries channel to be closed")
+		}
+	}
+}
+
+func TestRabbitMQReconnect(t *testing.T) {
+	dialer := &fakeDialer{}
+	r := NewRabbitMQ("amqp://fake", "work")
+	r.ReconnectDelay = time.Millisecond
+	r.dial = dialer.dial
+
+	deliveries, err := r.Connect(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer r.Close()
+
+	first := dialer.conn(t, 0)
+	first.ch.deliver("first")
+	if body := receive(t, deliveries); body != "first" {
+		t.Errorf("Unexpected delivery. Have %q, want %q.", body, "first")
+	}
+
+	// Failing the first attempt, to reconnect after the backoff
+	dialer.fail(true)
+	first.lose()
+	time.Sleep(10 * time.Millisecond)
+	dialer.fail(false)
+
+	second := dialer.conn(t, 1)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if queue, _ := second.ch.consuming(); queue != "" {
+			break
+		}
+	}
+	if !first.IsClosed() {
+		t.Errorf("Expected the lost connection to be closed")
+	}
+
+	queue, prefetch := second.ch.consuming()
+	if queue != "work" || prefetch != 3 {
+		t.Errorf("Unexpected consumer. Have %q (prefetch %d), want %q (prefetch %d).",
+			queue, prefetch, "work", 3)
+	}
+	if _, ok := second.ch.declared["work"]; !ok {
+		t.Errorf("Expected queue %q to be declared again", "work")
+	}
+
+	second.ch.deliver("second")
+	if body := receive(t, deliveries); body != "second" {
+		t.Errorf("Unexpected delivery. Have %q, want %q.", body, "second")
+	}
+}
+
+func TestRabbitMQCloseDuringBackoff(t *testing.T) {
+	dialer := &fakeDialer{}
+	r := NewRabbitMQ("amqp://fake", "work")
+	r.ReconnectDelay = time.Hour
+	r.dial = dialer.dial
+
+	deliveries, err := r.Connect(1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	first := dialer.conn(t, 0)
+	first.lose()
+	for start := time.Now(); !first.IsClosed() && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	r.Close()
+	closed(t, deliveries)
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if len(dialer.conns) != 1 {
+		t.Errorf("Unexpected reconnect after Close: %d connections", len(dialer.conns))
+	}
+}
+
+func TestRabbitMQCancelDuringReconnect(t *testing.T) {
+	dialer := &fakeDialer{}
+	r := NewRabbitMQ("amqp://fake", "work")
+	r.ReconnectDelay = time.Millisecond
+	r.dial = dialer.dial
+
+	deliveries, err := r.Connect(1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer r.Close()
+
+	dialer.fail(true)
+	dialer.conn(t, 0).lose()
+	if err = r.Cancel(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	dialer.fail(false)
+
+	second := dialer.conn(t, 1)
+	closed(t, deliveries)
+
+	if queue, _ := second.ch.consuming(); queue != "" {
+		t.Errorf("Unexpected consumer of %q after Cancel", queue)
+	}
+}
+
+func TestSessionPublishMandatory(t *testing.T) {
+	type testCase struct {
+		queue     string
+		mandatory bool
+	}
+
+	for name, tc := range map[string]testCase{
+		"queue":          {"example", true},
+		"direct reply":   {AMQPReplyTo + ".g1h2AA5yZXBseQ==", false},
+		"direct generic": {AMQPReplyTo, false},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ch := &fakeChannel{}
+			s := &session{ch: ch, confirms: newConfirms()}
+
+			confirmed, err := s.publish(tc.queue, amqp.Publishing{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if len(ch.published) != 1 {
+				t.Fatalf("Unexpected publishes: %+v", ch.published)
+			}
+
+			p := ch.published[0]
+			if p.key != tc.queue {
+				t.Errorf("Unexpected routing key. Have %q, want %q.", p.key, tc.queue)
+			}
+			if p.mandatory != tc.mandatory {
+				t.Errorf("Unexpected mandatory. Have %v, want %v.",
+					p.mandatory, tc.mandatory)
+			}
+
+			s.confirms.confirm(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+			if err = <-confirmed; err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
+// confirmingChannel mimics the publisher confirms of an AMQP channel: the
+// reader delivers the returns and confirms while holding the lock Publish needs.
+type confirmingChannel struct {
+	fakeChannel
+	lock          sync.Mutex
+	tag           uint64
+	queue         chan amqp.Return
+	confirmations chan amqp.Confirmation
+	returns       chan amqp.Return
+}
+
+func newConfirmingChannel(buffer int) *confirmingChannel {
+	return &confirmingChannel{
+		queue:         make(chan amqp.Return, 1000),
+		confirmations: make(chan amqp.Confirmation, buffer),
+		returns:       make(chan amqp.Return),
+	}
+}
+
+// Publish returns messages for the "missing" queue as unroutable.
+func (f *confirmingChannel) Publish(
+	exchange, key string, mandatory, immediate bool, msg amqp.Publishing,
+) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ret := amqp.Return{MessageId: msg.MessageId}
+	if key == "missing" {
+		ret.RoutingKey = key
+	}
+	f.queue <- ret
+	return f.fakeChannel.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+// dispatch delivers the returns and confirms of the messages published so far.
+// The caller must hold the lock.
+func (f *confirmingChannel) dispatch() {
+	for n := len(f.queue); n > 0; n-- {
+		ret := <-f.queue
+		f.tag++
+		if ret.RoutingKey != "" {
+			f.returns <- ret
+		}
+		f.confirmations <- amqp.Confirmation{DeliveryTag: f.tag, Ack: true}
+	}
+}
+
+// run dispatches the messages as they are published, until done is closed.
+func (f *confirmingChannel) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			f.lock.Lock()
+			f.dispatch()
+			f.lock.Unlock()
+		}
+	}
+}
+
+func TestSessionPublishWhileConfirming(t *testing.T) {
+	ch := newConfirmingChannel(4)
+	s := &session{ch: ch, confirms: newConfirms()}
+	r := &RabbitMQ{}
+	go r.listen(s, ch.confirmations, ch.returns)
+
+	// More messages awaiting their confirm than fit the confirmations buffer
+	var outcomes []<-chan error
+	for i := 0; i < 10; i++ {
+		confirmed, err := s.publish("example", amqp.Publishing{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		outcomes = append(outcomes, confirmed)
+	}
+
+	// Another message is published while the reader holds the lock
+	ch.lock.Lock()
+	published := make(chan (<-chan error))
+	go func() {
+		confirmed, _ := s.publish("example", amqp.Publishing{})
+		published <- confirmed
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	dispatched := make(chan struct{})
+	go func() {
+		ch.dispatch()
+		ch.lock.Unlock()
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publishing deadlocked with the confirms")
+	}
+
+	outcomes = append(outcomes, <-published)
+	ch.lock.Lock()
+	ch.dispatch()
+	ch.lock.Unlock()
+
+	for i, confirmed := range outcomes {
+		select {
+		case err := <-confirmed:
+			if err != nil {
+				t.Errorf("Unexpected error for message %d: %+v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected message %d confirmed", i)
+		}
+	}
+}
+
+func TestSessionPublishUnroutable(t *testing.T) {
+	type testCase struct {
+		undeliverable string
+		expected      error
+	}
+
+	for name, tc := range map[string]testCase{
+		"dropped": {"", ErrUnroutable},
+		"parked":  {"parked", nil},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ch := newConfirmingChannel(4)
+			s := &session{ch: ch, confirms: newConfirms()}
+			r := &RabbitMQ{Undeliverable: tc.undeliverable}
+			go r.listen(s, ch.confirmations, ch.returns)
+
+			done := make(chan struct{})
+			defer close(done)
+			go ch.run(done)
+
+			sent := make(chan error)
+			go func() {
+				sent <- r.publishOn(s, "missing", amqp.Publishing{})
+			}()
+
+			select {
+			case err := <-sent:
+				if !errors.Is(err, tc.expected) {
+					t.Errorf("Unexpected error. Have %v, want %v.", err, tc.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Publishing an unroutable message deadlocked")
+			}
+
+			if tc.undeliverable == "" {
+				return
+			}
+
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+			if len(ch.published) != 2 || ch.published[1].key != tc.undeliverable {
+				t.Fatalf("Expected message parked in %q: %+v",
+					tc.undeliverable, ch.published)
+			}
+			if q := ch.published[1].msg.Headers["x-undeliverable-queue"]; q != "missing" {
+				t.Errorf("Unexpected x-undeliverable-queue. Have %v, want %q.",
+					q, "missing")
+			}
+		})
+	}
+}
+
+func TestSendDelayedMessage(t *testing.T) {
+	type testCase struct {
+		delay time.Duration
+
+		queue   string
+		ttl     int64
+		expires int64
+	}
+
+	for name, tc := range map[string]testCase{
+		"second": {time.Second, "example.delay.1000ms", 1000, 61000},
+		"limit": {
+			maxTTL * time.Millisecond, "example.delay.4294967295ms",
+			maxTTL, maxTTL,
+		},
+		"beyond limit": {
+			time.Duration(math.MaxInt64), "example.delay.4294967295ms",
+			maxTTL, maxTTL,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ch := newConfirmingChannel(4)
+			r := &RabbitMQ{sess: &session{ch: ch, confirms: newConfirms()}}
+			go r.listen(r.sess, ch.confirmations, ch.returns)
+
+			done := make(chan struct{})
+			defer close(done)
+			go ch.run(done)
+
+			msg := payload.Message{
+				Routing: payload.Routing{Slip: []payload.Step{{Queue: "example"}}},
+			}
+			if err := r.SendDelayedMessage(msg, tc.delay); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+			args, ok := ch.declared[tc.queue]
+			if !ok {
+				t.Fatalf("Expected delay queue %q, got %+v", tc.queue, ch.declared)
+			}
+			if ttl := args["x-message-ttl"]; ttl != tc.ttl {
+				t.Errorf("Unexpected x-message-ttl. Have %v, want %d.", ttl, tc.ttl)
+			}
+			if expires := args["x-expires"]; expires != tc.expires {
+				t.Errorf("Unexpected x-expires. Have %v, want %d.", expires, tc.expires)
+			}
+		})
+	}
+}
+
+func TestPublishDeclare(t *testing.T) {
+	type testCase struct {
+		queue   string
+		failing bool
+
+		declared bool
+		expected error
+	}
+
+	for name, tc := range map[string]testCase{
+		"new queue":       {"dead-letters", false, true, nil},
+		"declared before": {"quorum", false, false, nil},
+		"failing declare": {"dead-letters", true, true, amqp.ErrClosed},
+		"direct reply-to": {AMQPReplyTo + ".abc", false, false, nil},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ch := newConfirmingChannel(4)
+			conn := &fakeConnection{
+				opened:    true,
+				conflicts: map[string]bool{"quorum": true},
+				failing:   tc.failing,
+			}
+			r := &RabbitMQ{
+				sess: &session{conn: conn, ch: ch, confirms: newConfirms()},
+			}
+			go r.listen(r.sess, ch.confirmations, ch.returns)
+
+			done := make(chan struct{})
+			defer close(done)
+			go ch.run(done)
+
+			err := r.Publish(tc.queue, []byte("{}"), nil)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("Unexpected error. Have %v, want %v.", err, tc.expected)
+			}
+
+			// A failed declare is tried again
+			conn.mu.Lock()
+			conn.failing = false
+			conn.mu.Unlock()
+			if err = r.Publish(tc.queue, []byte("{}"), nil); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+
+			if len(ch.declared) != 0 {
+				t.Errorf("Unexpected declare on the shared channel: %+v", ch.declared)
+			}
+
+			sent := 2
+			if tc.expected != nil {
+				sent = 1
+			}
+			if len(ch.published) != sent || ch.published[0].key != tc.queue {
+				t.Errorf("Expected %d message(s) published to %q: %+v",
+					sent, tc.queue, ch.published)
+			}
+			switch {
+			case isReplyTo(tc.queue):
+				if len(conn.aside) != 0 {
+					t.Errorf("Unexpected declare of %q", tc.queue)
+				}
+			case len(conn.aside) != 1:
+				t.Errorf("Expected a single declare on a channel aside, got %d",
+					len(conn.aside))
+			default:
+				if _, ok := conn.aside[0].declared[tc.queue]; ok != tc.declared {
+					t.Errorf("Unexpected declare of %q. Have %v, want %v.",
+						tc.queue, ok, tc.declared)
+				}
+			}
+		})
+	}
+}
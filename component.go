@@ -2,31 +2,93 @@ package gonyexpress
 
 import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"context"
 	"sync"
+	"time"
 
-	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Component is a RabbitMQ consumer / producer to do the heavy lifting for routing
 type Component struct {
 	// Broker is a utility wrapper around a RabbitMQ connection.
 	Broker broker.Broker
+	// DeadLetter is the default queue for messages which failed for good, used
+	// for steps without a dead-letter queue of their own. Malformed messages
+	// are sent here as is. Without any, such messages are dropped.
+	DeadLetter string
+	// Timeout is the default time limit for handling a message, used for
+	// steps without a Timeout of their own. Zero means no limit.
+	Timeout time.Duration
+	// DrainTimeout is the time the operators get to finish the messages in
+	// flight when draining the Component. Zero means DefaultDrainTimeout.
+	DrainTimeout time.Duration
+	// Metrics collects Prometheus metrics of the Component, if set. The same
+	// Metrics can be shared by several Components.
+	Metrics *Metrics
+	// TracerProvider creates the OpenTelemetry spans of the Component. Without
+	// one, the global TracerProvider is used.
+	TracerProvider trace.TracerProvider
+	// Logger receives the log lines of the Component, and of a RabbitMQ Broker
+	// without a Logger of its own. Without one, logger.Default is used.
+	Logger logger.Logger
+	// queue is the name of the queue the Component consumes
+	queue string
 	// Operator is thread-safe function called for every message
-	operator Operator
+	operator ContextOperator
+	// middlewares wrap the operator, see Use
+	middlewares []Middleware
+	// chained is the operator wrapped in the middlewares, set by Run
+	chained ContextOperator
+	// handle is called by the workers for every valid message
+	handle func(c *Component, d broker.Delivery, msg *payload.Message, step *payload.Step)
 	// Worker channel to communicate start shutdown
 	shutdown chan bool
+	// ctx is passed to the operator, and cancelled on shutdown
+	ctx context.Context
+	// cancel cancels ctx
+	cancel context.CancelFunc
 	// wg is the WaitGroup synchronizing the shutdown of all Workers
 	wg sync.WaitGroup
+	// health tracks the state reported by Health
+	health health
 	// Workers is the number of workers to spawn
 	workers int
+	// prefetch is the number of unacknowledged deliveries to receive, twice
+	// the number of workers if zero
+	prefetch int
+	// replies passes Direct Reply-To messages to Call, for a Producer
+	replies *replies
 }
 
+// unlimitedPrefetch receives deliveries without limit, i.e. a Qos prefetch count
+// of zero.
+const unlimitedPrefetch = -1
+
 // Connect opens up a RabbitMQ connection and returns a channel through which
-// Messages are delivered.
-func (c *Component) Connect() (<-chan amqp.Delivery, error) {
-	return c.Broker.Connect(c.workers * 2)
+// Messages are delivered. For a Producer on AMQPReplyTo, replies to a Call are
+// not passed on through the channel.
+func (c *Component) Connect() (<-chan broker.Delivery, error) {
+	if rmq, ok := c.Broker.(*broker.RabbitMQ); ok && rmq.Logger == nil {
+		rmq.Logger = c.Logger
+	}
+
+	prefetch := c.prefetch
+	switch {
+	case prefetch == unlimitedPrefetch:
+		prefetch = 0
+	case prefetch == 0:
+		prefetch = c.workers * 2
+	}
+
+	msgs, err := c.Broker.Connect(prefetch)
+	if err != nil || c.replies == nil {
+		return msgs, err
+	}
+	return c.replies.dispatch(msgs, c.log()), nil
 }
 
 // Close terminates the RabbitMQ channel and connection. Should be used when
@@ -36,7 +98,49 @@ func (c *Component) Close() {
 	c.Broker.Close()
 }
 
-// SendMessage sends a message onto the message's current Slip queue
+// SendMessage sends a message onto the message's current Slip queue. A message
+// without a trace yet starts one.
 func (c *Component) SendMessage(msg payload.Message) error {
-	return c.Broker.SendMessage(msg)
+	return c.SendMessageContext(context.Background(), msg)
+}
+
+// SendMessageContext sends a message like SendMessage. A message without a trace
+// yet starts one as child of the span in the context, if any.
+func (c *Component) SendMessageContext(ctx context.Context, msg payload.Message) error {
+	if _, ok := msg.MetaData[payload.TraceContext]; ok {
+		return c.Broker.SendMessage(msg)
+	}
+
+	msg, span := c.startSend(ctx, msg)
+	err := c.Broker.SendMessage(msg)
+	endSpan(span, err)
+	return err
+}
+
+// log returns the Logger of the Component.
+func (c *Component) log() logger.Logger {
+	if c.Logger == nil {
+		return logger.Default()
+	}
+	return c.Logger
+}
+
+// logMessage returns the Logger of the Component, with the fields describing
+// the message.
+func (c *Component) logMessage(msg *payload.Message) logger.Logger {
+	return c.log().WithFields(logger.Fields{
+		logger.TraceID:  msg.TraceID,
+		logger.Route:    msg.Routing.Name,
+		logger.Position: msg.Routing.Position,
+		logger.Queue:    c.queue,
+	})
+}
+
+// logDelivery returns the Logger of the Component, with the fields describing
+// a delivery which may not hold a valid message.
+func (c *Component) logDelivery(d broker.Delivery) logger.Logger {
+	return c.log().WithFields(logger.Fields{
+		logger.TraceID: d.CorrelationID(),
+		logger.Queue:   c.queue,
+	})
 }
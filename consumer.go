@@ -4,21 +4,36 @@ import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
 	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"context"
+	"encoding/json"
 	"fmt"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 )
 
 // NewConsumer creates a Consumer Component instance ready to connect to the
 // rabbitmq + queue and execute the operator function for every recieved
 // message.
 func NewConsumer(URI, qname string, workers int, operator Operator) Component {
+	return NewContextConsumer(URI, qname, workers, operator.WithContext())
+}
+
+// NewContextConsumer creates a Consumer Component instance like NewConsumer,
+// but for an operator which receives a context.
+func NewContextConsumer(URI, qname string, workers int, operator ContextOperator) Component {
+	var handle func(*Component, broker.Delivery, *pl.Message, *pl.Step)
+	if operator != nil {
+		handle = (*Component).process
+	}
+
 	return Component{
 		Broker:   broker.New(URI, qname),
+		queue:    qname,
 		operator: operator,
+		handle:   handle,
 		workers:  workers,
 		wg:       sync.WaitGroup{},
 	}
@@ -31,9 +46,29 @@ type Operator func(
 	traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
 ) (*pl.Documents, *pl.MetaData, error)
 
+// ContextOperator is an Operator which also receives a context. The context is
+// cancelled when the Component shuts down, so the operator can abort cleanly.
+type ContextOperator func(
+	ctx context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+) (*pl.Documents, *pl.MetaData, error)
+
+// WithContext adapts the Operator to a ContextOperator, which ignores the
+// context.
+func (o Operator) WithContext() ContextOperator {
+	if o == nil {
+		return nil
+	}
+
+	return func(
+		_ context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+	) (*pl.Documents, *pl.MetaData, error) {
+		return o(traceID, md, args, docs)
+	}
+}
+
 // Run launches the Component as a background service.
 func (c *Component) Run() error {
-	if c.operator == nil {
+	if c.handle == nil {
 		return fmt.Errorf("cannot Run without operator")
 	}
 	if c.workers < 1 {
@@ -45,16 +80,19 @@ func (c *Component) Run() error {
 		c.Close()
 		return errors.Wrap(err, "Failed to connect to RabbitMQ")
 	}
-	log.Info("Successfully Connected to our RabbitMQ Instance")
+	c.log().Infof("Successfully Connected to our RabbitMQ Instance")
 
+	c.chained = c.chain()
+	c.health.shutdown(false)
 	c.shutdown = make(chan bool)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	for i := 0; i < c.workers; i++ {
 		c.wg.Add(1)
-		go c.worker(msgs)
+		go c.worker(msgs, c.shutdown)
 	}
 
-	log.Info("Component running")
+	c.log().Infof("Component running")
 	return nil
 }
 
@@ -64,105 +102,293 @@ func (c *Component) IsShuttingDown() <-chan bool {
 	return c.shutdown
 }
 
-func (c *Component) worker(msgs <-chan amqp.Delivery) {
+func (c *Component) worker(msgs <-chan broker.Delivery, shutdown <-chan bool) {
 	defer c.wg.Done()
 
-	log.Info("Launched worker...")
+	c.health.started()
+	defer c.health.stopped()
+
+	c.log().Infof("Launched worker...")
 
 	for {
 		select {
-		case <-c.IsShuttingDown():
-			log.Warning("Shutting down worker...")
+		case <-shutdown:
+			c.log().Warnf("Shutting down worker...")
 			return
 
-		case d := <-msgs:
-			msg, err := pl.MessageFromByteSlice(d.Body)
+		case d, ok := <-msgs:
+			if !ok {
+				c.log().Warnf("Delivery channel closed. Stopping worker...")
+				return
+			}
+
+			msg, err := pl.MessageFromByteSlice(d.Body())
 
 			if err != nil {
-				log.Errorf("%s - Bad message: %+v in %+v\n",
-					d.CorrelationId, err, d.Body)
-				// TODO: enable retry
-				d.Nack(false, false)
+				c.logDelivery(d).Errorf("Bad message: %+v in %+v", err, d.Body())
+				c.Metrics.malform(c.queue)
+				c.deadLetterBody(d, err)
 				continue
 			}
+			c.Metrics.receive(c.queue, msg.Routing.Name)
+
+			if replyTo := d.ReplyTo(); replyTo != "" {
+				broker.ResolveReplyTo(msg, replyTo)
+			}
 
 			step, err := msg.CurrentStep()
 			if err != nil {
-				log.Errorf("%s - Bad message: %+v in %+v\n",
-					d.CorrelationId, err, d.Body)
-				// TODO: enable retry
-				d.Nack(false, false)
+				c.logMessage(msg).Errorf("Bad message: %+v in %+v", err, d.Body())
+				c.deadLetter(d, msg, err)
 				continue
 			}
 
-			if _, ok := msg.MetaData["ping"]; ok {
-				c.advance(d, msg, nil, nil)
-				continue
+			done := c.Metrics.track(c.queue)
+			if _, ok := msg.MetaData[pl.Ping]; ok {
+				c.pong(d, msg)
+			} else {
+				c.safely(d, msg, step)
 			}
+			done()
+		}
+	}
+}
 
-			pl, md, err := c.operator(
-				msg.TraceID,
-				msg.MetaData,
-				step.Arguments,
-				msg.Documents,
-			)
+// ErrPanic is the failure recorded when handling a message panics.
+var ErrPanic = errors.New("panic")
 
-			if err != nil {
-				c.retry(d, msg, err)
-			} else {
-				c.advance(d, msg, pl, md)
-			}
+// PanicError converts a value recovered from a panic into an ErrPanic error,
+// including the stack trace.
+func PanicError(r interface{}) error {
+	return fmt.Errorf("%w: %v\n%s", ErrPanic, r, debug.Stack())
+}
+
+// safely handles the message, recovering from a panic to keep the worker alive.
+// The message is then retried, like any failure.
+func (c *Component) safely(d broker.Delivery, msg *pl.Message, step *pl.Step) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := PanicError(r)
+			c.logMessage(msg).Errorf("Recovered from %+v", err)
+			c.retry(d, msg, err)
 		}
+	}()
+
+	c.handle(c, d, msg, step)
+}
+
+// process runs the operator for the message, and advances or retries it
+// depending on the outcome.
+func (c *Component) process(d broker.Delivery, msg *pl.Message, step *pl.Step) {
+	ctx, span := c.startStep(c.ctx, msg, step)
+
+	start := time.Now()
+	docs, md, err := c.operate(ctx, msg, step)
+	elapsed := time.Since(start)
+	endSpan(span, err)
+	c.Metrics.observe(c.queue, msg.Routing.Name, elapsed)
+
+	switch {
+	case err != nil && c.ctx.Err() != nil:
+		c.logMessage(msg).Warnf("Aborted by shutdown: %+v", err)
+		d.Nack(true)
+	case err != nil:
+		status := c.retry(d, msg, err)
+		c.progress(msg, status, elapsed, err)
+	default:
+		status, err := c.advance(d, msg, docs, md)
+		c.progress(msg, status, elapsed, err)
+	}
+}
+
+// pong advances a ping message without handling it, recording the time it
+// passed the step.
+func (c *Component) pong(d broker.Delivery, msg *pl.Message) {
+	status, err := c.advance(d, msg, nil, msg.Hop(time.Now()))
+	c.progress(msg, status, 0, err)
+}
+
+// ErrTimeout is the failure recorded when an operator exceeds the step timeout.
+var ErrTimeout = errors.New("step timed out")
+
+// operate calls the operator for the message at the current step. If the step,
+// or the Component, declares a timeout, the operator context expires after it,
+// and an operator still running by then is abandoned.
+func (c *Component) operate(ctx context.Context, msg *pl.Message, step *pl.Step) (*pl.Documents, *pl.MetaData, error) {
+	timeout := time.Duration(step.Timeout)
+	if timeout <= 0 {
+		timeout = c.Timeout
+	}
+	if timeout <= 0 {
+		return c.call(ctx, msg, step)
 	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		docs *pl.Documents
+		md   *pl.MetaData
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		docs, md, err := c.call(ctx, msg, step)
+		done <- result{docs, md, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+
+	if r.err != nil && ctx.Err() == context.DeadlineExceeded {
+		r.err = fmt.Errorf("%w after %s", ErrTimeout, timeout)
+	}
+	return r.docs, r.md, r.err
+}
+
+// call calls the operator for the message at the step, and converts a panic of
+// the operator into an error.
+func (c *Component) call(ctx context.Context, msg *pl.Message, step *pl.Step) (
+	docs *pl.Documents, md *pl.MetaData, err error,
+) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError(r)
+		}
+	}()
+
+	return c.chained(ctx, msg.TraceID, msg.MetaData, step.Arguments, msg.Documents)
 }
 
-// advance will send the message to the next step on the route
-func (c *Component) advance(d amqp.Delivery, msg *pl.Message, docs *pl.Documents, md *pl.MetaData) {
+// advance will send the message to the next step on the route. The delivery is
+// only acknowledged once the next message has been sent, which includes the
+// publisher confirm. Returns the progress status of the step, with the error if
+// the message was dead-lettered instead, or no status if it was requeued.
+func (c *Component) advance(d broker.Delivery, msg *pl.Message, docs *pl.Documents, md *pl.MetaData) (pl.ProgressStatus, error) {
 	next, err := msg.Advance(docs, md)
 	if err != nil {
-		log.Errorf("%s - Failed to produce next message: %+v\n", d.CorrelationId, err)
-		d.Nack(false, false)
-		return
+		c.logMessage(msg).Errorf("Failed to produce next message: %+v", err)
+		return failedStatus(c.deadLetter(d, msg, err)), err
 	}
 
 	if next == nil {
-		d.Ack(false)
-		return
+		c.logMessage(msg).Debugf("Finished route")
+		c.succeeded(msg)
+		d.Ack()
+		return pl.ProgressDone, nil
 	}
+	c.logMessage(next).Debugf("Advancing to step %d / %d",
+		next.Routing.Position+1, len(next.Routing.Slip))
 
 	err = c.SendMessage(*next)
 	if err != nil {
-		log.Errorf("%s - Failed to send message: %+v\n", d.CorrelationId, err)
-		d.Nack(false, true)
+		return failedStatus(c.failedSend(d, next, err)), err
 	}
-	d.Ack(false)
+	c.succeeded(msg)
+	d.Ack()
+	return pl.ProgressDone, nil
+}
+
+// failedStatus returns the progress status of a message which failed for good,
+// or no status if it was requeued instead, to be reported once redelivered.
+func failedStatus(deadLettered bool) pl.ProgressStatus {
+	if !deadLettered {
+		return ""
+	}
+	return pl.ProgressFailed
+}
+
+// succeeded records the message was handled successfully.
+func (c *Component) succeeded(msg *pl.Message) {
+	c.Metrics.process(c.queue, msg.Routing.Name)
+	c.health.succeeded()
 }
 
-// retry will send the message back to retry another time, if configured
-func (c *Component) retry(d amqp.Delivery, msg *pl.Message, e error) {
+// retry will send the message back to retry another time, if configured, after
+// the backoff delay of the failed step. Otherwise the message is dead-lettered.
+// Returns the progress status of the step, or no status if the message was
+// requeued.
+func (c *Component) retry(d broker.Delivery, msg *pl.Message, e error) pl.ProgressStatus {
+	var delay time.Duration
+	if step, err := msg.CurrentStep(); err == nil {
+		delay = step.RetryDelay()
+	}
+
 	next, err := msg.Retry(e)
 	if err != nil {
-		log.Errorf("%s - Failed to produc retry message: %+v\n",
-			d.CorrelationId, err)
+		c.logMessage(msg).Errorf("Failed to produce retry message: %+v", err)
 	}
 
 	if next == nil {
-		d.Ack(false)
-		return
+		c.logMessage(msg).Debugf("Giving up on step")
+		return failedStatus(c.deadLetter(d, msg, e))
 	}
+	c.logMessage(next).Debugf("Retrying step %d / %d",
+		next.Routing.Position+1, len(next.Routing.Slip))
 
-	err = c.SendMessage(*next)
+	err = c.Broker.SendDelayedMessage(*next, delay)
 	if err != nil {
-		log.Errorf("%s - Failed to send message: %+v\n", d.CorrelationId, err)
-		d.Nack(false, true)
+		return failedStatus(c.failedSend(d, next, err))
+	}
+	c.Metrics.retry(c.queue, msg.Routing.Name)
+	d.Ack()
+	return pl.ProgressRetrying
+}
+
+// progressHeader marks a Progress event published to the ProgressQueue, to tell
+// it apart from replies on a Direct Reply-To queue.
+const progressHeader = "x-gonyexpress-progress"
+
+// progress publishes the event with the status of the step to the
+// ProgressQueue of the message, if any. Without a status, as the message was
+// requeued, nothing is published. Progress events are best effort, so failures
+// are only logged.
+func (c *Component) progress(msg *pl.Message, status pl.ProgressStatus, elapsed time.Duration, e error) {
+	queue, _ := msg.MetaData[pl.ProgressQueue].(string)
+	if queue == "" || status == "" {
 		return
 	}
-	d.Ack(false)
+
+	body, err := json.Marshal(msg.Progress(status, elapsed, e))
+	if err == nil {
+		err = c.Broker.Publish(queue, body, map[string]interface{}{
+			progressHeader: true,
+		})
+	}
+	if err != nil {
+		c.logMessage(msg).Warnf("Failed to publish progress: %+v", err)
+	}
+}
+
+// failedSend handles a message which could not be sent. Unroutable messages
+// will never be delivered, so they are dead-lettered. Otherwise the delivery
+// is requeued to try again later. Returns whether the message was
+// dead-lettered.
+func (c *Component) failedSend(d broker.Delivery, next *pl.Message, err error) bool {
+	c.logMessage(next).Errorf("Failed to send message: %+v", err)
+
+	if errors.Is(err, broker.ErrUnroutable) {
+		return c.deadLetter(d, next, err)
+	}
+	d.Nack(true)
+	return false
 }
 
 // Shutdown will notify all workers to stop, and wait for all to finish.
 func (c *Component) Shutdown() {
-	log.Println("Shutting down")
+	c.stop(true)
+}
+
+// stop notifies all workers to stop, and cancels the operator context. Unless
+// waiting for the workers to finish, the Broker is closed right away, which
+// requeues the deliveries still in flight.
+func (c *Component) stop(wait bool) {
+	c.log().Infof("Shutting down")
 	if c.shutdown == nil {
 		return
 	}
@@ -171,8 +397,12 @@ func (c *Component) Shutdown() {
 	case <-c.shutdown:
 		// Not running
 	default:
+		c.health.shutdown(true)
 		close(c.shutdown)
-		c.wg.Wait()
+		c.cancel()
+		if wait {
+			c.wg.Wait()
+		}
 		c.Close()
 		c.shutdown = nil
 	}
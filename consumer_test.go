@@ -1,15 +1,21 @@
 package gonyexpress_test
 
 import (
+	"context"
 	"time"
 
 	ge "github.com/SebastiaanPasterkamp/gonyexpress"
 	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"encoding/json"
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestNewRunShutdownWithError(t *testing.T) {
@@ -70,7 +76,10 @@ func TestConsumer(t *testing.T) {
 		},
 	)
 
-	m.DeliverMessage(orig)
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
 
 	msg, err := m.TakeMessage(1 * time.Second)
 	if err != nil {
@@ -98,6 +107,10 @@ func TestConsumer(t *testing.T) {
 		}
 	}
 
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
 	c.Shutdown()
 }
 
@@ -140,11 +153,63 @@ func TestConsumerPing(t *testing.T) {
 		if msg.TraceID != orig.TraceID {
 			t.Errorf("TraceID changed. Have %q, want %q.", msg.TraceID, orig.TraceID)
 		}
+		if hops := msg.Hops(); len(hops) != 1 || hops[0].Queue != "foo" {
+			t.Errorf("Expected hop for 'foo', got %+v", hops)
+		}
 	}
 
 	c.Shutdown()
 }
 
+func TestConsumerReplyTo(t *testing.T) {
+	operator := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-consumer",
+			Slip: []payload.Step{
+				{Queue: "foo"},
+				{Queue: "bar"},
+				{Queue: broker.AMQPReplyTo},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a message, got nil")
+	}
+	if d.Queue != "bar" || d.ReplyTo() != "" {
+		t.Errorf("Unexpected message to %q, reply-to %q.", d.Queue, d.ReplyTo())
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if q := msg.Routing.Slip[2].Queue; q != broker.MockReplyTo {
+		t.Errorf("Unresolved reply step. Have %q, want %q.", q, broker.MockReplyTo)
+	}
+}
+
 func TestBadInit(t *testing.T) {
 	operator := func(
 		traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
@@ -202,7 +267,10 @@ func TestConsumerFailure(t *testing.T) {
 		},
 	)
 
-	m.DeliverMessage(orig)
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
 
 	msg, err := m.TakeMessage(1 * time.Second)
 	if err != nil {
@@ -212,5 +280,466 @@ func TestConsumerFailure(t *testing.T) {
 		t.Errorf("Unexpected message %+v", msg)
 	}
 
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	c.Shutdown()
+}
+
+func TestContextConsumerShutdown(t *testing.T) {
+	started := make(chan bool)
+	operator := func(
+		ctx context.Context, _ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+
+	c := ge.NewContextConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-shutdown",
+			Slip: []payload.Step{
+				{
+					Queue:         "foo",
+					ErrorHandling: payload.ErrorHandling{MaxRetries: 3},
+				},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Operator was not called")
+	}
+
 	c.Shutdown()
+
+	s, requeue := delivery.Settlement(1 * time.Second)
+	if s != broker.Nacked || !requeue {
+		t.Errorf("Unexpected settlement. Have %q (requeue %v), want %q (requeue true).",
+			s, requeue, broker.Nacked)
+	}
+}
+
+func TestConsumerStepTimeout(t *testing.T) {
+	operator := func(
+		ctx context.Context, _ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+
+	c := ge.NewContextConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-timeout",
+			Slip: []payload.Step{
+				{
+					Queue:         "foo",
+					ErrorHandling: payload.ErrorHandling{MaxRetries: 1},
+					Timeout:       payload.Duration(10 * time.Millisecond),
+				},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	m.DeliverMessage(orig)
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if msg == nil {
+		t.Fatalf("Expected a retry message, got nil")
+	}
+
+	step, err := msg.CurrentStep()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if step.Attempt != 1 {
+		t.Errorf("Unexpected attempt. Have %d, want %d.", step.Attempt, 1)
+	}
+	if len(step.Log) != 1 || !strings.Contains(step.Log[0], "timed out after 10ms") {
+		t.Errorf("Expected timeout to be logged. Have %+v.", step.Log)
+	}
+}
+
+func TestConsumerDefaultTimeout(t *testing.T) {
+	operator := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		time.Sleep(200 * time.Millisecond)
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	c.Timeout = 10 * time.Millisecond
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-timeout",
+			Slip: []payload.Step{
+				{
+					Queue:         "foo",
+					ErrorHandling: payload.ErrorHandling{MaxRetries: 1},
+				},
+				{Queue: "bar"},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	m.DeliverMessage(orig)
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if msg == nil {
+		t.Fatalf("Expected a retry message, got nil")
+	}
+	if msg.Routing.Position != 0 {
+		t.Errorf("Expected retry of first step. Have position %d, want %d.",
+			msg.Routing.Position, 0)
+	}
+}
+
+func TestConsumerRetryBackoff(t *testing.T) {
+	operator := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, fmt.Errorf("Please fail this message")
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-backoff",
+			Slip: []payload.Step{
+				{
+					Queue: "foo",
+					ErrorHandling: payload.ErrorHandling{
+						MaxRetries: 3,
+						Attempt:    2,
+						Backoff: &payload.Backoff{
+							Initial:    payload.Duration(time.Second),
+							Multiplier: 3.0,
+						},
+					},
+				},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	m.DeliverMessage(orig)
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a retry message, got nil")
+	}
+	if d.Delay != 9*time.Second {
+		t.Errorf("Unexpected retry delay. Have %v, want %v.", d.Delay, 9*time.Second)
+	}
+	if d.Queue != "foo" {
+		t.Errorf("Unexpected retry queue. Have %q, want %q.", d.Queue, "foo")
+	}
+}
+
+func TestConsumerProgress(t *testing.T) {
+	c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name: "test-progress",
+			Slip: []payload.Step{
+				{Queue: "foo", ErrorHandling: payload.ErrorHandling{MaxRetries: 1}},
+				{Queue: "bar"},
+			},
+		},
+		payload.MetaData{payload.ProgressQueue: "progress"},
+		payload.Documents{},
+	)
+
+	for _, want := range []payload.ProgressStatus{
+		payload.ProgressRetrying,
+		payload.ProgressFailed,
+	} {
+		if _, err := m.DeliverMessage(orig); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+
+		var d *broker.MockDelivery
+		for {
+			if d = m.TakeDelivery(1 * time.Second); d == nil || d.Queue == "progress" {
+				break
+			}
+			if msg, err := payload.MessageFromByteSlice(d.Body()); err == nil {
+				orig = *msg
+			}
+		}
+		if d == nil {
+			t.Fatalf("Expected a progress event, got nil")
+		}
+		if _, ok := d.Headers()["x-gonyexpress-progress"]; !ok {
+			t.Errorf("Missing progress header in %+v.", d.Headers())
+		}
+
+		var event payload.Progress
+		if err := json.Unmarshal(d.Body(), &event); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if event.Status != want {
+			t.Errorf("Unexpected status. Have %q, want %q.", event.Status, want)
+		}
+		if event.TraceID != orig.TraceID || event.Route != "test-progress" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+		if event.Queue != "foo" || event.Position != 0 || event.Steps != 2 {
+			t.Errorf("Unexpected event step: %+v", event)
+		}
+		if event.Error != "Please fail this message" {
+			t.Errorf("Unexpected event error: %q", event.Error)
+		}
+	}
+}
+
+func TestConsumerPanic(t *testing.T) {
+	for name, timeout := range map[string]time.Duration{
+		"without timeout": 0,
+		"with timeout":    time.Second,
+	} {
+		timeout := timeout
+		t.Run(name, func(t *testing.T) {
+			operator := func(
+				_ string, md payload.MetaData, _ payload.Arguments, _ payload.Documents,
+			) (*payload.Documents, *payload.MetaData, error) {
+				if _, ok := md["panic"]; ok {
+					panic("Please panic")
+				}
+				return nil, nil, nil
+			}
+
+			c := ge.NewConsumer("mock://", "test", 1, operator)
+			c.Timeout = timeout
+			m := c.Broker.(*broker.MockBroker)
+
+			if err := c.Run(); err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+			defer c.Shutdown()
+
+			orig := payload.NewMessage(
+				payload.Routing{
+					Name: "test-panic",
+					Slip: []payload.Step{
+						{Queue: "foo", ErrorHandling: payload.ErrorHandling{MaxRetries: 1}},
+						{Queue: "bar"},
+					},
+				},
+				payload.MetaData{"panic": true},
+				payload.Documents{},
+			)
+
+			delivery, err := m.DeliverMessage(orig)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			msg, err := m.TakeMessage(1 * time.Second)
+			if err != nil || msg == nil {
+				t.Fatalf("Expected a retry message, got %+v, %+v", msg, err)
+			}
+			if msg.Routing.Position != 0 || msg.Routing.Slip[0].Attempt != 1 {
+				t.Errorf("Expected a retry, got %+v", msg.Routing)
+			}
+			log := msg.Routing.Slip[0].Log
+			if len(log) != 1 || !strings.Contains(log[0], "Please panic") ||
+				!strings.Contains(log[0], "goroutine") {
+				t.Errorf("Expected panic with stack trace in log, got %+v", log)
+			}
+			if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+				t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+			}
+
+			// The worker survived
+			orig.MetaData = payload.MetaData{}
+			if _, err = m.DeliverMessage(orig); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if msg, _ = m.TakeMessage(1 * time.Second); msg == nil {
+				t.Fatalf("Expected a message, got nil")
+			}
+			if msg.Routing.Position != 1 {
+				t.Errorf("Expected position advance. Have %d, want %d.", msg.Routing.Position, 1)
+			}
+		})
+	}
+}
+
+func TestConsumerLogger(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	c := ge.NewConsumer("mock://", "test", 1, func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, fmt.Errorf("Please fail this message")
+	})
+	c.Logger = logger.Logrus(l)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-logger",
+			Position: 1,
+			Slip:     []payload.Step{{Queue: "foo"}, {Queue: "test"}},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "Dropping failed message") {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("Expected the failed message to be logged, got %+v", hook.AllEntries())
+	}
+
+	for key, want := range map[string]interface{}{
+		logger.TraceID:  orig.TraceID,
+		logger.Route:    "test-logger",
+		logger.Position: 1,
+		logger.Queue:    "test",
+	} {
+		if have := entry.Data[key]; have != want {
+			t.Errorf("Unexpected %q field. Have %v, want %v.", key, have, want)
+		}
+	}
+}
+
+// failingSend is a MockBroker unable to send messages to the next step.
+type failingSend struct {
+	*broker.MockBroker
+}
+
+func (f failingSend) SendMessage(payload.Message) error {
+	return fmt.Errorf("queue unavailable")
+}
+
+func (f failingSend) SendDelayedMessage(payload.Message, time.Duration) error {
+	return fmt.Errorf("queue unavailable")
+}
+
+func TestConsumerProgressRequeued(t *testing.T) {
+	succeeding := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, nil
+	}
+
+	for name, operator := range map[string]ge.Operator{
+		"advance": succeeding,
+		"retry":   failingOperator,
+	} {
+		operator := operator
+		t.Run(name, func(t *testing.T) {
+			c := ge.NewConsumer("mock://", "test", 1, operator)
+			m := c.Broker.(*broker.MockBroker)
+			c.Broker = failingSend{m}
+
+			if err := c.Run(); err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+			defer c.Shutdown()
+
+			delivery, err := m.DeliverMessage(payload.NewMessage(
+				payload.Routing{
+					Name: "test-progress",
+					Slip: []payload.Step{
+						{Queue: "foo", ErrorHandling: payload.ErrorHandling{MaxRetries: 1}},
+						{Queue: "bar"},
+					},
+				},
+				payload.MetaData{payload.ProgressQueue: "progress"},
+				payload.Documents{},
+			))
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			s, requeue := delivery.Settlement(1 * time.Second)
+			if s != broker.Nacked || !requeue {
+				t.Errorf("Unexpected settlement. Have %q (requeue %v), want %q.",
+					s, requeue, broker.Nacked)
+			}
+			if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+				t.Errorf("Unexpected progress event for a requeued message: %s",
+					d.Body())
+			}
+		})
+	}
 }
@@ -0,0 +1,87 @@
+package gonyexpress
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// deadLetter sends the failed message to the dead-letter queue of the current
+// step, or the Component default, including the final error. If completed steps
+// declare a compensation, it is sent once the message is parked, so a failure to
+// park it never leads to compensating twice. The delivery is only acknowledged
+// once both are sent, or if there is no dead-letter queue to park it in.
+// Returns whether the delivery was acknowledged, rather than requeued.
+func (c *Component) deadLetter(d broker.Delivery, msg *pl.Message, e error) bool {
+	dead := msg.DeadLetter(e)
+
+	comp := msg.Compensation(e)
+	if comp != nil {
+		dead.MetaData[pl.Compensated] = true
+	}
+
+	queue := c.DeadLetter
+	if step, err := msg.CurrentStep(); err == nil && step.DeadLetter != "" {
+		queue = step.DeadLetter
+	}
+
+	if queue == "" {
+		c.logMessage(msg).Warnf("Dropping failed message: %+v", e)
+	} else {
+		body, err := json.Marshal(dead)
+		if err == nil {
+			err = c.Broker.Publish(queue, body, nil)
+		}
+		if err != nil {
+			c.logMessage(msg).Errorf("Failed to dead-letter message: %+v", err)
+			d.Nack(true)
+			return false
+		}
+		c.logMessage(msg).Warnf("Sent failed message to %q: %+v", queue, e)
+	}
+	c.Metrics.deadLetter(c.queue, msg.Routing.Name)
+
+	if comp != nil {
+		err := c.SendMessage(*comp)
+		switch {
+		case errors.Is(err, broker.ErrUnroutable):
+			// Retrying won't help, so leave the message parked.
+			c.logMessage(msg).Errorf("Failed to send compensation: %+v", err)
+		case err != nil:
+			// Parks the message again on redelivery, but compensates only once.
+			c.logMessage(msg).Errorf("Failed to send compensation: %+v", err)
+			d.Nack(true)
+			return false
+		default:
+			c.logMessage(msg).Warnf("Sent compensation for %d step(s)",
+				len(comp.Routing.Slip))
+		}
+	}
+
+	d.Ack()
+	return true
+}
+
+// deadLetterBody sends a malformed message body as is to the default
+// dead-letter queue, with the error in the headers. Without a dead-letter
+// queue, the message is dropped.
+func (c *Component) deadLetterBody(d broker.Delivery, e error) {
+	if c.DeadLetter == "" {
+		d.Nack(false)
+		return
+	}
+
+	err := c.Broker.Publish(c.DeadLetter, d.Body(), map[string]interface{}{
+		"x-dead-letter-error": e.Error(),
+	})
+	if err != nil {
+		c.logDelivery(d).Errorf("Failed to dead-letter message: %+v", err)
+		d.Nack(true)
+		return
+	}
+
+	d.Ack()
+}
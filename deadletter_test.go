@@ -0,0 +1,270 @@
+package gonyexpress_test
+
+import (
+	"time"
+
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"testing"
+)
+
+func failingOperator(
+	_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+) (*payload.Documents, *payload.MetaData, error) {
+	return nil, nil, fmt.Errorf("Please fail this message")
+}
+
+var deadLetterCases = []struct {
+	Name          string
+	Default       string
+	Step          string
+	ExpectedQueue string
+}{
+	{"Default", "dead-letters", "", "dead-letters"},
+	{"Step", "dead-letters", "step-letters", "step-letters"},
+	{"Step only", "", "step-letters", "step-letters"},
+}
+
+func TestDeadLetter(t *testing.T) {
+	for _, tc := range deadLetterCases {
+		tc := tc // capture range variable
+		t.Run(tc.Name, func(t *testing.T) {
+			c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+			c.DeadLetter = tc.Default
+			m := c.Broker.(*broker.MockBroker)
+
+			if err := c.Run(); err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+			defer c.Shutdown()
+
+			orig := payload.NewMessage(
+				payload.Routing{
+					Name: "test-dead-letter",
+					Slip: []payload.Step{
+						{
+							Queue: "foo",
+							ErrorHandling: payload.ErrorHandling{
+								MaxRetries: 1,
+								Attempt:    1,
+								DeadLetter: tc.Step,
+							},
+							Log: []string{"First failure"},
+						},
+						{Queue: "bar"},
+					},
+				},
+				payload.MetaData{},
+				payload.Documents{},
+			)
+
+			delivery, err := m.DeliverMessage(orig)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			d := m.TakeDelivery(1 * time.Second)
+			if d == nil {
+				t.Fatalf("Expected a dead-lettered message, got nil")
+			}
+			if d.Queue != tc.ExpectedQueue {
+				t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, tc.ExpectedQueue)
+			}
+
+			msg, err := payload.MessageFromByteSlice(d.Body())
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if msg.TraceID != orig.TraceID {
+				t.Errorf("TraceID changed. Have %q, want %q.", msg.TraceID, orig.TraceID)
+			}
+
+			log := msg.Routing.Slip[0].Log
+			if len(log) != 2 || log[1] != "Please fail this message" {
+				t.Errorf("Unexpected log. Have %+v.", log)
+			}
+			if e := msg.MetaData[payload.DeadLetterError]; e != "Please fail this message" {
+				t.Errorf("Unexpected %q. Have %+v.", payload.DeadLetterError, e)
+			}
+
+			if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+				t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+			}
+		})
+	}
+}
+
+func TestDeadLetterMalformed(t *testing.T) {
+	c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+	c.DeadLetter = "dead-letters"
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	delivery := m.DeliverBody([]byte(`{"broken"`))
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a dead-lettered message, got nil")
+	}
+	if d.Queue != "dead-letters" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "dead-letters")
+	}
+	if string(d.Body()) != `{"broken"` {
+		t.Errorf("Unexpected body. Have %q, want %q.", d.Body(), `{"broken"`)
+	}
+	if _, ok := d.Headers()["x-dead-letter-error"]; !ok {
+		t.Errorf("Missing error header in %+v.", d.Headers())
+	}
+
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+}
+
+func TestDeadLetterMalformedDropped(t *testing.T) {
+	c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	delivery := m.DeliverBody([]byte(`{"broken"`))
+
+	s, requeue := delivery.Settlement(1 * time.Second)
+	if s != broker.Nacked || requeue {
+		t.Errorf("Unexpected settlement. Have %q (requeue %v), want %q.",
+			s, requeue, broker.Nacked)
+	}
+}
+
+func TestDeadLetterCompensation(t *testing.T) {
+	c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+	c.DeadLetter = "dead-letters"
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-compensation",
+			Position: 3,
+			Slip: []payload.Step{
+				{Queue: "reserve", Compensate: "release"},
+				{Queue: "upload", Compensate: "delete"},
+				{Queue: "skipped", Compensate: "never", Skipped: true},
+				{Queue: "charge", Compensate: "refund"},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a dead-lettered message, got nil")
+	}
+	if d.Queue != "dead-letters" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "dead-letters")
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if msg.MetaData[payload.Compensated] != true {
+		t.Errorf("Expected dead-lettered message marked %q: %+v",
+			payload.Compensated, msg.MetaData)
+	}
+	if msg.Compensation(fmt.Errorf("again")) != nil {
+		t.Errorf("Expected no compensation for a compensated message")
+	}
+
+	d = m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a compensation message, got nil")
+	}
+	if d.Queue != "delete" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "delete")
+	}
+
+	comp, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if comp.TraceID != orig.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", comp.TraceID, orig.TraceID)
+	}
+	if len(comp.Routing.Slip) != 2 || comp.Routing.Slip[1].Queue != "release" {
+		t.Errorf("Unexpected compensation slip: %+v", comp.Routing.Slip)
+	}
+	if r := comp.MetaData[payload.CompensationReason]; r != "Please fail this message" {
+		t.Errorf("Unexpected %q. Have %+v.", payload.CompensationReason, r)
+	}
+
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+}
+
+// failingPublish is a MockBroker unable to publish to the dead-letter queue.
+type failingPublish struct {
+	*broker.MockBroker
+}
+
+func (f failingPublish) Publish(string, []byte, map[string]interface{}) error {
+	return fmt.Errorf("dead-letter queue unavailable")
+}
+
+func TestDeadLetterCompensationUnparked(t *testing.T) {
+	c := ge.NewConsumer("mock://", "test", 1, failingOperator)
+	c.DeadLetter = "dead-letters"
+	m := c.Broker.(*broker.MockBroker)
+	c.Broker = failingPublish{m}
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	delivery, err := m.DeliverMessage(payload.NewMessage(
+		payload.Routing{
+			Name:     "test-compensation",
+			Position: 1,
+			Slip: []payload.Step{
+				{Queue: "reserve", Compensate: "release"},
+				{Queue: "charge"},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	s, requeue := delivery.Settlement(1 * time.Second)
+	if s != broker.Nacked || !requeue {
+		t.Errorf("Unexpected settlement. Have %q (requeue %v), want %q.",
+			s, requeue, broker.Nacked)
+	}
+	if d := m.TakeDelivery(100 * time.Millisecond); d != nil {
+		t.Errorf("Unexpected compensation sent to %q before parking.", d.Queue)
+	}
+}
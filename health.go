@@ -0,0 +1,113 @@
+package gonyexpress
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health is the state of a Component, as reported by the health endpoints.
+type Health struct {
+	// Connected tells if the Broker is connected
+	Connected bool `json:"connected"`
+	// Workers is the number of workers running
+	Workers int `json:"workers"`
+	// MaxWorkers is the number of workers the Component launches
+	MaxWorkers int `json:"max_workers"`
+	// LastSuccess is when a message was last handled successfully, if ever
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// ShuttingDown tells if the Component is shutting down, or shut down
+	ShuttingDown bool `json:"shutting_down"`
+}
+
+// Live tells if the Component is working as intended, i.e. connected with all
+// workers running. A Component shutting down is left to finish.
+func (h Health) Live() bool {
+	return h.ShuttingDown || (h.Connected && h.Workers >= h.MaxWorkers)
+}
+
+// Ready tells if the Component is able to handle messages.
+func (h Health) Ready() bool {
+	return !h.ShuttingDown && h.Connected && h.Workers >= h.MaxWorkers
+}
+
+// health tracks the state of the Component reported in Health.
+type health struct {
+	mu           sync.Mutex
+	workers      int
+	lastSuccess  time.Time
+	shuttingDown bool
+}
+
+func (h *health) started() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.workers++
+}
+
+func (h *health) stopped() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.workers--
+}
+
+func (h *health) succeeded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = time.Now()
+}
+
+func (h *health) shutdown(shuttingDown bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = shuttingDown
+}
+
+// Health reports the current state of the Component.
+func (c *Component) Health() Health {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+
+	h := Health{
+		Connected:    c.Broker.Connected(),
+		Workers:      c.health.workers,
+		MaxWorkers:   c.workers,
+		ShuttingDown: c.health.shuttingDown,
+	}
+	if !c.health.lastSuccess.IsZero() {
+		last := c.health.lastSuccess
+		h.LastSuccess = &last
+	}
+	return h
+}
+
+// HealthHandler returns a http.Handler serving the Health of the Component on
+// a /healthz liveness, and a /readyz readiness endpoint. Both respond with
+// status 503 Service Unavailable if the check fails.
+func (c *Component) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Ready())
+	})
+	return mux
+}
+
+// ListenAndServeHealth serves the HealthHandler on the address. It blocks, like
+// http.ListenAndServe.
+func (c *Component) ListenAndServeHealth(addr string) error {
+	return http.ListenAndServe(addr, c.HealthHandler())
+}
+
+func writeHealth(w http.ResponseWriter, h Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
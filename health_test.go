@@ -0,0 +1,97 @@
+package gonyexpress_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	operator := func(
+		traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 2, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	srv := httptest.NewServer(c.HealthHandler())
+	defer srv.Close()
+
+	probe := func(t *testing.T, endpoint string, want int) ge.Health {
+		t.Helper()
+
+		resp, err := srv.Client().Get(srv.URL + endpoint)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("Unexpected %s status. Have %d, want %d.",
+				endpoint, resp.StatusCode, want)
+		}
+
+		var h ge.Health
+		if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return h
+	}
+
+	// Not running yet
+	probe(t, "/healthz", http.StatusServiceUnavailable)
+	probe(t, "/readyz", http.StatusServiceUnavailable)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	for start := time.Now(); c.Health().Workers < 2; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Workers failed to start: %+v", c.Health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h := probe(t, "/readyz", http.StatusOK)
+	if h.Workers != 2 || h.MaxWorkers != 2 || !h.Connected || h.LastSuccess != nil {
+		t.Errorf("Unexpected health: %+v", h)
+	}
+
+	delivery, err := m.DeliverMessage(payload.NewMessage(
+		payload.Routing{Name: "test-health", Slip: []payload.Step{{Queue: "test"}}},
+		payload.MetaData{},
+		payload.Documents{},
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	delivery.Settlement(time.Second)
+
+	h = probe(t, "/healthz", http.StatusOK)
+	if h.LastSuccess == nil {
+		t.Errorf("Expected the last success to be reported: %+v", h)
+	}
+
+	// Lost connection
+	m.SetConnected(false)
+	probe(t, "/healthz", http.StatusServiceUnavailable)
+	probe(t, "/readyz", http.StatusServiceUnavailable)
+	m.SetConnected(true)
+
+	c.Shutdown()
+
+	h = probe(t, "/healthz", http.StatusOK)
+	if !h.ShuttingDown || h.Workers != 0 {
+		t.Errorf("Unexpected health: %+v", h)
+	}
+	probe(t, "/readyz", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,51 @@
+// Package logger defines the structured Logger used by the Gony Express, along
+// with adapters for common logging libraries.
+package logger
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are structured key-value pairs added to every line of a Logger.
+type Fields map[string]interface{}
+
+// The field names used for the Message being handled.
+const (
+	// TraceID is the field holding the TraceID of the Message
+	TraceID = "trace_id"
+	// Route is the field holding the name of the route of the Message
+	Route = "route"
+	// Position is the field holding the position on the routing slip
+	Position = "position"
+	// Queue is the field holding the name of the queue of the Component
+	Queue = "queue"
+)
+
+// Logger is a leveled, structured logger.
+type Logger interface {
+	// WithFields returns a Logger adding the fields to every line
+	WithFields(fields Fields) Logger
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Default returns the Logger used when none is configured, which logs through
+// the standard logrus logger.
+func Default() Logger {
+	return Logrus(logrus.StandardLogger())
+}
+
+// Nop returns a Logger which discards everything.
+func Nop() Logger {
+	return nop{}
+}
+
+type nop struct{}
+
+func (n nop) WithFields(Fields) Logger    { return n }
+func (nop) Debugf(string, ...interface{}) {}
+func (nop) Infof(string, ...interface{})  {}
+func (nop) Warnf(string, ...interface{})  {}
+func (nop) Errorf(string, ...interface{}) {}
@@ -0,0 +1,69 @@
+package logger_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
+
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogrus(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.SetLevel(logrus.DebugLevel)
+
+	log := logger.Logrus(l).WithFields(logger.Fields{logger.TraceID: "trace"})
+	log.WithFields(logger.Fields{logger.Queue: "queue"}).Warnf("Hello %s", "world")
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatalf("Expected a log entry")
+	}
+	if entry.Message != "Hello world" {
+		t.Errorf("Unexpected message. Have %q, want %q.", entry.Message, "Hello world")
+	}
+	if entry.Level != logrus.WarnLevel {
+		t.Errorf("Unexpected level. Have %v, want %v.", entry.Level, logrus.WarnLevel)
+	}
+	for key, want := range map[string]string{
+		logger.TraceID: "trace",
+		logger.Queue:   "queue",
+	} {
+		if have := entry.Data[key]; have != want {
+			t.Errorf("Unexpected %q field. Have %v, want %q.", key, have, want)
+		}
+	}
+}
+
+func TestZap(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	log := logger.Zap(zap.New(core)).WithFields(logger.Fields{logger.TraceID: "trace"})
+	log.Errorf("Hello %s", "world")
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected number of entries. Have %d, want %d.", len(entries), 1)
+	}
+	if entries[0].Message != "Hello world" {
+		t.Errorf("Unexpected message. Have %q, want %q.", entries[0].Message, "Hello world")
+	}
+	if entries[0].Level != zapcore.ErrorLevel {
+		t.Errorf("Unexpected level. Have %v, want %v.", entries[0].Level, zapcore.ErrorLevel)
+	}
+	if have := entries[0].ContextMap()[logger.TraceID]; have != "trace" {
+		t.Errorf("Unexpected %q field. Have %v, want %q.", logger.TraceID, have, "trace")
+	}
+}
+
+func TestNop(t *testing.T) {
+	log := logger.Nop().WithFields(logger.Fields{logger.TraceID: "trace"})
+	log.Debugf("Hello")
+	log.Infof("Hello")
+	log.Warnf("Hello")
+	log.Errorf("Hello")
+}
@@ -0,0 +1,18 @@
+package logger
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Logrus adapts a logrus Logger, or Entry, to a Logger.
+func Logrus(l logrus.FieldLogger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	logrus.FieldLogger
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.FieldLogger.WithFields(logrus.Fields(fields))}
+}
@@ -0,0 +1,49 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Slog adapts a log/slog Logger to a Logger.
+func Slog(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) WithFields(fields Fields) Logger {
+	args := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return slogLogger{s.l.With(args...)}
+}
+
+func (s slogLogger) log(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if s.l.Enabled(ctx, level) {
+		s.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s slogLogger) Debugf(format string, args ...interface{}) {
+	s.log(slog.LevelDebug, format, args)
+}
+
+func (s slogLogger) Infof(format string, args ...interface{}) {
+	s.log(slog.LevelInfo, format, args)
+}
+
+func (s slogLogger) Warnf(format string, args ...interface{}) {
+	s.log(slog.LevelWarn, format, args)
+}
+
+func (s slogLogger) Errorf(format string, args ...interface{}) {
+	s.log(slog.LevelError, format, args)
+}
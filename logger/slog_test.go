@@ -0,0 +1,35 @@
+//go:build go1.21
+
+package logger_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
+
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	log := logger.Slog(l).WithFields(logger.Fields{logger.TraceID: "trace"})
+	log.Debugf("Hidden")
+	log.Infof("Hello %s", "world")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Unexpected error: %+v in %q", err, buf.String())
+	}
+	for key, want := range map[string]string{
+		"msg":          "Hello world",
+		"level":        "INFO",
+		logger.TraceID: "trace",
+	} {
+		if have := line[key]; have != want {
+			t.Errorf("Unexpected %q. Have %v, want %q.", key, have, want)
+		}
+	}
+}
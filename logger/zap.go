@@ -0,0 +1,22 @@
+package logger
+
+import (
+	"go.uber.org/zap"
+)
+
+// Zap adapts a zap Logger to a Logger.
+func Zap(l *zap.Logger) Logger {
+	return zapLogger{l.Sugar()}
+}
+
+type zapLogger struct {
+	*zap.SugaredLogger
+}
+
+func (z zapLogger) WithFields(fields Fields) Logger {
+	args := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return zapLogger{z.SugaredLogger.With(args...)}
+}
@@ -0,0 +1,138 @@
+package gonyexpress
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects Prometheus metrics for one or more Components, labelled by
+// the queue of the Component and the name of the route. A nil *Metrics
+// collects nothing.
+type Metrics struct {
+	received     *prometheus.CounterVec
+	processed    *prometheus.CounterVec
+	retried      *prometheus.CounterVec
+	deadLettered *prometheus.CounterVec
+	malformed    *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+}
+
+// NewMetrics creates the Metrics, and registers them with the Registerer, e.g.
+// prometheus.DefaultRegisterer, or a fresh prometheus.NewRegistry() in tests.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	labels := []string{"queue", "route"}
+
+	m := &Metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_received_total",
+			Help:      "Number of valid messages received.",
+		}, labels),
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_processed_total",
+			Help:      "Number of messages advanced to the next step.",
+		}, labels),
+		retried: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_retried_total",
+			Help:      "Number of failed messages sent back to retry.",
+		}, labels),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_dead_lettered_total",
+			Help:      "Number of messages which failed for good.",
+		}, labels),
+		malformed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_malformed_total",
+			Help:      "Number of messages which could not be parsed.",
+		}, []string{"queue"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gonyexpress",
+			Name:      "operator_duration_seconds",
+			Help:      "Time spent in the operator.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "gonyexpress",
+			Name:      "messages_in_flight",
+			Help:      "Number of messages currently being handled.",
+		}, []string{"queue"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.received, m.processed, m.retried, m.deadLettered,
+		m.malformed, m.duration, m.inFlight,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// MetricsHandler returns a http.Handler exposing the metrics of the Gatherer,
+// e.g. prometheus.DefaultGatherer.
+func MetricsHandler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// ListenAndServeMetrics serves the metrics of the Gatherer on the /metrics
+// endpoint of the address. It blocks, like http.ListenAndServe.
+func ListenAndServeMetrics(addr string, g prometheus.Gatherer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(g))
+	return http.ListenAndServe(addr, mux)
+}
+
+func (m *Metrics) receive(queue, route string) {
+	if m != nil {
+		m.received.WithLabelValues(queue, route).Inc()
+	}
+}
+
+func (m *Metrics) process(queue, route string) {
+	if m != nil {
+		m.processed.WithLabelValues(queue, route).Inc()
+	}
+}
+
+func (m *Metrics) retry(queue, route string) {
+	if m != nil {
+		m.retried.WithLabelValues(queue, route).Inc()
+	}
+}
+
+func (m *Metrics) deadLetter(queue, route string) {
+	if m != nil {
+		m.deadLettered.WithLabelValues(queue, route).Inc()
+	}
+}
+
+func (m *Metrics) malform(queue string) {
+	if m != nil {
+		m.malformed.WithLabelValues(queue).Inc()
+	}
+}
+
+func (m *Metrics) observe(queue, route string, elapsed time.Duration) {
+	if m != nil {
+		m.duration.WithLabelValues(queue, route).Observe(elapsed.Seconds())
+	}
+}
+
+// track counts the message as in flight, until the returned func is called.
+func (m *Metrics) track(queue string) func() {
+	if m == nil {
+		return func() {}
+	}
+
+	g := m.inFlight.WithLabelValues(queue)
+	g.Inc()
+	return g.Dec
+}
@@ -0,0 +1,133 @@
+package gonyexpress_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	operator := func(
+		traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		if _, ok := args["fail"]; ok {
+			return nil, nil, fmt.Errorf("Please fail this message")
+		}
+		return nil, nil, nil
+	}
+
+	reg := prometheus.NewRegistry()
+	metrics, err := ge.NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	c.Metrics = metrics
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	good := payload.NewMessage(
+		payload.Routing{
+			Name: "good",
+			Slip: []payload.Step{{Queue: "test"}, {Queue: "next"}},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+	bad := payload.NewMessage(
+		payload.Routing{
+			Name: "bad",
+			Slip: []payload.Step{{
+				Queue:         "test",
+				Arguments:     payload.Arguments{"fail": true},
+				ErrorHandling: payload.ErrorHandling{MaxRetries: 1},
+			}},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	if _, err := m.DeliverMessage(good); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if d := m.TakeDelivery(time.Second); d == nil {
+		t.Fatalf("Expected the good message to advance")
+	}
+
+	if _, err := m.DeliverMessage(bad); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	retry := m.TakeDelivery(time.Second)
+	if retry == nil {
+		t.Fatalf("Expected the bad message to be retried")
+	}
+	if s, _ := m.Deliver(retry).Settlement(time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	if s, _ := m.DeliverBody([]byte("garbage")).Settlement(time.Second); s != broker.Nacked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Nacked)
+	}
+
+	for name, tc := range map[string]struct {
+		metric string
+		want   string
+	}{
+		"received good": {
+			`gonyexpress_messages_received_total{queue="test",route="good"}`, "1"},
+		"received bad": {
+			`gonyexpress_messages_received_total{queue="test",route="bad"}`, "2"},
+		"processed": {
+			`gonyexpress_messages_processed_total{queue="test",route="good"}`, "1"},
+		"retried": {
+			`gonyexpress_messages_retried_total{queue="test",route="bad"}`, "1"},
+		"dead-lettered": {
+			`gonyexpress_messages_dead_lettered_total{queue="test",route="bad"}`, "1"},
+		"malformed": {
+			`gonyexpress_messages_malformed_total{queue="test"}`, "1"},
+		"duration": {
+			`gonyexpress_operator_duration_seconds_count{queue="test",route="bad"}`, "2"},
+		"in flight": {
+			`gonyexpress_messages_in_flight{queue="test"}`, "0"},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			body := scrape(t, reg)
+			if !strings.Contains(body, tc.metric+" "+tc.want+"\n") {
+				t.Errorf("Unexpected metrics. Have %s, want %s %s.",
+					body, tc.metric, tc.want)
+			}
+		})
+	}
+}
+
+func scrape(t *testing.T, g prometheus.Gatherer) string {
+	srv := httptest.NewServer(ge.MetricsHandler(g))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	return string(body)
+}
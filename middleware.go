@@ -0,0 +1,47 @@
+package gonyexpress
+
+import (
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+)
+
+// Middleware wraps a ContextOperator to add cross-cutting behaviour, such as
+// logging or metrics, around every call.
+type Middleware func(next ContextOperator) ContextOperator
+
+// OperatorMiddleware adapts a middleware for an Operator into a Middleware. The
+// context is passed along to the wrapped ContextOperator as is.
+func OperatorMiddleware(m func(next Operator) Operator) Middleware {
+	return func(next ContextOperator) ContextOperator {
+		return func(
+			ctx context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+		) (*pl.Documents, *pl.MetaData, error) {
+			op := m(func(
+				traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+			) (*pl.Documents, *pl.MetaData, error) {
+				return next(ctx, traceID, md, args, docs)
+			})
+			return op(traceID, md, args, docs)
+		}
+	}
+}
+
+// Use adds middlewares around the operator of the Component. The first
+// middleware is the outermost, and middlewares added by later calls are nested
+// inside earlier ones. Must be called before Run.
+func (c *Component) Use(middlewares ...Middleware) {
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// chain wraps the operator in the middlewares of the Component.
+func (c *Component) chain() ContextOperator {
+	op := c.operator
+	if op == nil {
+		return nil
+	}
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		op = c.middlewares[i](op)
+	}
+	return op
+}
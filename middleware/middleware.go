@@ -0,0 +1,73 @@
+// Package middleware provides common Middleware to wrap the operator of a
+// Component with, through Component.Use.
+package middleware
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"time"
+)
+
+// Logging logs every call of the operator, and how it ended, to the Logger, or
+// logger.Default if nil.
+func Logging(l logger.Logger) ge.Middleware {
+	if l == nil {
+		l = logger.Default()
+	}
+
+	return func(next ge.ContextOperator) ge.ContextOperator {
+		return func(
+			ctx context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+		) (*pl.Documents, *pl.MetaData, error) {
+			log := l.WithFields(logger.Fields{logger.TraceID: traceID})
+			log.Infof("Operator called")
+			start := time.Now()
+
+			d, m, err := next(ctx, traceID, md, args, docs)
+
+			if err != nil {
+				log.Warnf("Operator failed after %s: %+v", time.Since(start), err)
+			} else {
+				log.Infof("Operator done after %s", time.Since(start))
+			}
+			return d, m, err
+		}
+	}
+}
+
+// Timing reports how long every call of the operator took, and whether it
+// failed.
+func Timing(report func(traceID string, elapsed time.Duration, err error)) ge.Middleware {
+	return func(next ge.ContextOperator) ge.ContextOperator {
+		return func(
+			ctx context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+		) (*pl.Documents, *pl.MetaData, error) {
+			start := time.Now()
+			d, m, err := next(ctx, traceID, md, args, docs)
+			report(traceID, time.Since(start), err)
+			return d, m, err
+		}
+	}
+}
+
+// Recovery converts a panic of the operator into an ErrPanic error. The
+// Component recovers from panics itself, but a Recovery middleware lets the
+// outer middlewares see the failure.
+func Recovery() ge.Middleware {
+	return func(next ge.ContextOperator) ge.ContextOperator {
+		return func(
+			ctx context.Context, traceID string, md pl.MetaData, args pl.Arguments, docs pl.Documents,
+		) (d *pl.Documents, m *pl.MetaData, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = ge.PanicError(r)
+				}
+			}()
+
+			return next(ctx, traceID, md, args, docs)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package middleware_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
+	"github.com/SebastiaanPasterkamp/gonyexpress/middleware"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func operator(err error, panics bool) ge.ContextOperator {
+	return func(
+		ctx context.Context, traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		if panics {
+			panic("boom")
+		}
+		return &docs, &md, err
+	}
+}
+
+func TestLogging(t *testing.T) {
+	failure := errors.New("failure")
+
+	for name, tc := range map[string]struct {
+		err error
+	}{
+		"success": {nil},
+		"failure": {failure},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			op := middleware.Logging(logger.Nop())(operator(tc.err, false))
+
+			docs, _, err := op(context.Background(), "trace", payload.MetaData{},
+				payload.Arguments{}, payload.Documents{"doc": payload.NewDocument("a", "text/plain", "")})
+			if err != tc.err {
+				t.Errorf("Unexpected error. Have %v, want %v.", err, tc.err)
+			}
+			if _, ok := (*docs)["doc"]; !ok {
+				t.Errorf("Unexpected documents. Have %+v, want %q.", *docs, "doc")
+			}
+		})
+	}
+}
+
+func TestTiming(t *testing.T) {
+	failure := errors.New("failure")
+
+	var (
+		traceID string
+		elapsed time.Duration
+		failed  error
+	)
+	op := middleware.Timing(func(id string, d time.Duration, err error) {
+		traceID, elapsed, failed = id, d, err
+	})(func(
+		ctx context.Context, traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil, failure
+	})
+
+	_, _, err := op(context.Background(), "trace", payload.MetaData{},
+		payload.Arguments{}, payload.Documents{})
+	if err != failure {
+		t.Errorf("Unexpected error. Have %v, want %v.", err, failure)
+	}
+	if traceID != "trace" {
+		t.Errorf("Unexpected traceID. Have %q, want %q.", traceID, "trace")
+	}
+	if elapsed < 10*time.Millisecond {
+		t.Errorf("Unexpected elapsed time. Have %s, want at least %s.",
+			elapsed, 10*time.Millisecond)
+	}
+	if failed != failure {
+		t.Errorf("Unexpected reported error. Have %v, want %v.", failed, failure)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var reported error
+	op := middleware.Timing(func(_ string, _ time.Duration, err error) {
+		reported = err
+	})(middleware.Recovery()(operator(nil, true)))
+
+	_, _, err := op(context.Background(), "trace", payload.MetaData{},
+		payload.Arguments{}, payload.Documents{})
+	if !errors.Is(err, ge.ErrPanic) {
+		t.Errorf("Unexpected error. Have %v, want %v.", err, ge.ErrPanic)
+	}
+	if !errors.Is(reported, ge.ErrPanic) {
+		t.Errorf("Unexpected reported error. Have %v, want %v.", reported, ge.ErrPanic)
+	}
+}
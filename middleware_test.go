@@ -0,0 +1,76 @@
+package gonyexpress_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComponentUse(t *testing.T) {
+	var calls []string
+
+	trace := func(name string) ge.Middleware {
+		return func(next ge.ContextOperator) ge.ContextOperator {
+			return func(
+				ctx context.Context, traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+			) (*payload.Documents, *payload.MetaData, error) {
+				calls = append(calls, name)
+				return next(ctx, traceID, md, args, docs)
+			}
+		}
+	}
+
+	legacy := ge.OperatorMiddleware(func(next ge.Operator) ge.Operator {
+		return func(
+			traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+		) (*payload.Documents, *payload.MetaData, error) {
+			calls = append(calls, "legacy")
+			return next(traceID, md, args, docs)
+		}
+	})
+
+	operator := func(
+		traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		calls = append(calls, "operator")
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	c.Use(trace("first"), trace("second"))
+	c.Use(legacy)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	delivery, err := m.DeliverMessage(payload.NewMessage(
+		payload.Routing{
+			Name: "test-use",
+			Slip: []payload.Step{{Queue: "test"}, {Queue: "next"}},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	if s, _ := delivery.Settlement(time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	have := strings.Join(calls, ",")
+	want := "first,second,legacy,operator"
+	if have != want {
+		t.Errorf("Unexpected call order. Have %q, want %q.", have, want)
+	}
+}
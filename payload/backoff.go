@@ -0,0 +1,68 @@
+package payload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff declares how long to wait before retrying a failed step. The first
+// retry waits for Initial, and every further attempt multiplies the delay by
+// Multiplier, up to Max. Jitter randomizes the delay by up to the given
+// fraction, e.g. 0.1 for +/- 10%, to avoid retries happening in lockstep.
+type Backoff struct {
+	Initial    Duration `json:"initial"`
+	Multiplier float64  `json:"multiplier,omitempty"`
+	Max        Duration `json:"max,omitempty"`
+	Jitter     float64  `json:"jitter,omitempty"`
+}
+
+// Delay returns the time to wait before the next retry, given the number of
+// retries already attempted. Returns zero without a Backoff.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	if b == nil || b.Initial <= 0 {
+		return 0
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1.0 {
+		multiplier = 1.0
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		delay += delay * math.Min(b.Jitter, 1.0) * (2*rand.Float64() - 1)
+	}
+
+	// Without a Max the delay grows beyond what a Duration can hold
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+func (b *Backoff) validate() []string {
+	if b == nil {
+		return nil
+	}
+
+	var problems []string
+	if b.Initial < 0 {
+		problems = append(problems, fmt.Sprintf("negative initial %s", time.Duration(b.Initial)))
+	}
+	if b.Multiplier != 0 && b.Multiplier < 1.0 {
+		problems = append(problems, fmt.Sprintf("multiplier %g below 1", b.Multiplier))
+	}
+	if b.Max < 0 {
+		problems = append(problems, fmt.Sprintf("negative max %s", time.Duration(b.Max)))
+	}
+	if b.Jitter < 0 || b.Jitter > 1.0 {
+		problems = append(problems, fmt.Sprintf("jitter %g outside of 0 to 1", b.Jitter))
+	}
+	return problems
+}
@@ -0,0 +1,56 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"math"
+	"testing"
+	"time"
+)
+
+var backoffCases = []struct {
+	Name    string
+	Backoff *payload.Backoff
+	Attempt int
+
+	ExpectedMin time.Duration
+	ExpectedMax time.Duration
+}{
+	{"None", nil, 3, 0, 0},
+	{"Constant", &payload.Backoff{Initial: payload.Duration(time.Second)}, 3,
+		time.Second, time.Second},
+	{"First", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Multiplier: 2.0,
+	}, 0, time.Second, time.Second},
+	{"Exponential", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Multiplier: 2.0,
+	}, 3, 8 * time.Second, 8 * time.Second},
+	{"Capped", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Multiplier: 2.0,
+		Max: payload.Duration(5 * time.Second),
+	}, 3, 5 * time.Second, 5 * time.Second},
+	{"Jitter", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Jitter: 0.1,
+	}, 0, 900 * time.Millisecond, 1100 * time.Millisecond},
+	{"Uncapped", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Multiplier: 10.0,
+	}, 100, math.MaxInt64, math.MaxInt64},
+	{"Overflow", &payload.Backoff{
+		Initial: payload.Duration(time.Second), Multiplier: 2.0,
+	}, 2000, math.MaxInt64, math.MaxInt64},
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tc := range backoffCases {
+		tc := tc // capture range variable
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			d := tc.Backoff.Delay(tc.Attempt)
+			if d < tc.ExpectedMin || d > tc.ExpectedMax {
+				t.Errorf("Delay = %v; expected between %v and %v",
+					d, tc.ExpectedMin, tc.ExpectedMax)
+			}
+		})
+	}
+}
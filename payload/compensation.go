@@ -0,0 +1,66 @@
+package payload
+
+const (
+	// CompensationReason is the MetaData key holding the error for which the
+	// steps of a Message are compensated.
+	CompensationReason = "compensation_reason"
+	// CompensationQueue is the MetaData key holding the queue of the step which
+	// failed, causing the compensation.
+	CompensationQueue = "compensation_queue"
+	// Compensated is the MetaData key marking a failed Message for which the
+	// compensation was already sent.
+	Compensated = "compensated"
+)
+
+// Compensation creates a Message to compensate the side effects of the steps
+// completed before the current, failed, step. The slip holds the Compensate
+// queue of every completed step, in reverse order, with the Arguments and
+// ErrorHandling of the step. The error is recorded in the MetaData. Returns nil
+// if there is nothing to compensate, or the Message was compensated before.
+func (msg Message) Compensation(e error) *Message {
+	if _, ok := msg.MetaData[Compensated]; ok {
+		return nil
+	}
+	if msg.Routing.Position <= 0 || msg.Routing.Position > len(msg.Routing.Slip) {
+		return nil
+	}
+
+	var slip []Step
+	for i := msg.Routing.Position - 1; i >= 0; i-- {
+		step := msg.Routing.Slip[i]
+		if step.Compensate == "" || step.Skipped {
+			continue
+		}
+
+		slip = append(slip, Step{
+			Queue:     step.Compensate,
+			Arguments: step.Arguments,
+			ErrorHandling: ErrorHandling{
+				MaxRetries: step.MaxRetries,
+				Backoff:    step.Backoff,
+				DeadLetter: step.DeadLetter,
+			},
+			Timeout: step.Timeout,
+		})
+	}
+	if len(slip) == 0 {
+		return nil
+	}
+
+	md := MetaData{
+		CompensationReason: e.Error(),
+	}
+	if step, err := msg.CurrentStep(); err == nil {
+		md[CompensationQueue] = step.Queue
+	}
+
+	return &Message{
+		Routing: Routing{
+			Name: msg.Routing.Name,
+			Slip: slip,
+		},
+		TraceID:   msg.TraceID,
+		MetaData:  msg.combineMetaData(&md),
+		Documents: msg.Documents,
+	}
+}
@@ -0,0 +1,74 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"testing"
+)
+
+func TestCompensation(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-compensation",
+			Position: 2,
+			Slip: []payload.Step{
+				{
+					Queue:      "reserve",
+					Compensate: "release",
+					Arguments:  payload.Arguments{"item": "foo"},
+					ErrorHandling: payload.ErrorHandling{
+						MaxRetries: 3,
+						Attempt:    2,
+						Rewind:     1,
+					},
+				},
+				{Queue: "upload"},
+				{Queue: "charge", Compensate: "refund"},
+			},
+		},
+		payload.MetaData{"meta": "data"},
+		payload.Documents{},
+	)
+	e := fmt.Errorf("example")
+
+	comp := msg.Compensation(e)
+	if comp == nil {
+		t.Fatalf("Expected compensation message, got nil")
+	}
+	if comp.TraceID != msg.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", comp.TraceID, msg.TraceID)
+	}
+	if comp.Routing.Position != 0 || len(comp.Routing.Slip) != 1 {
+		t.Fatalf("Unexpected compensation routing: %+v", comp.Routing)
+	}
+
+	step := comp.Routing.Slip[0]
+	if step.Queue != "release" || step.Arguments["item"] != "foo" {
+		t.Errorf("Unexpected compensation step: %+v", step)
+	}
+	if step.MaxRetries != 3 || step.Attempt != 0 || step.Rewind != 0 {
+		t.Errorf("Unexpected compensation error handling: %+v", step.ErrorHandling)
+	}
+
+	if r := comp.MetaData[payload.CompensationReason]; r != "example" {
+		t.Errorf("Unexpected %q. Have %+v.", payload.CompensationReason, r)
+	}
+	if q := comp.MetaData[payload.CompensationQueue]; q != "charge" {
+		t.Errorf("Unexpected %q. Have %+v.", payload.CompensationQueue, q)
+	}
+	if comp.MetaData["meta"] != "data" {
+		t.Errorf("Unexpected 'meta' metadata in %+v", comp.MetaData)
+	}
+
+	msg.Routing.Position = 0
+	if comp = msg.Compensation(e); comp != nil {
+		t.Errorf("Unexpected compensation of first step: %+v", comp)
+	}
+
+	msg.Routing.Position = 2
+	msg.MetaData[payload.Compensated] = true
+	if comp = msg.Compensation(e); comp != nil {
+		t.Errorf("Unexpected compensation of compensated message: %+v", comp)
+	}
+}
@@ -0,0 +1,258 @@
+package payload
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+)
+
+// Condition decides whether a Step is executed, based on the MetaData and
+// Documents of the Message. All criteria set on a Condition must hold. An empty
+// Condition always holds.
+//
+// For example, to only run a step for image documents:
+//
+//	when:
+//	  content_type: image/*
+type Condition struct {
+	// MetaData is the key of a MetaData value which must be present. With an
+	// Op, the value is compared to Value instead.
+	MetaData string `json:"metadata,omitempty"`
+	// Op is one of the Comparison operators, e.g. "eq" or "gt".
+	Op Comparison `json:"op,omitempty"`
+	// Value is compared to the MetaData value using Op.
+	Value interface{} `json:"value,omitempty"`
+	// Document is the name of a Document which must be present.
+	Document string `json:"document,omitempty"`
+	// ContentType is a pattern, e.g. "image/*", which the content type of the
+	// Document must match, or of any Document if none is named.
+	ContentType string `json:"content_type,omitempty"`
+	// All holds if all of the nested conditions hold.
+	All []Condition `json:"all,omitempty"`
+	// Any holds if at least one of the nested conditions holds.
+	Any []Condition `json:"any,omitempty"`
+	// Not holds if the nested condition does not.
+	Not *Condition `json:"not,omitempty"`
+}
+
+// Comparison is the operator comparing a MetaData value in a Condition.
+type Comparison string
+
+const (
+	// OpEqual holds if the value equals the Condition Value
+	OpEqual Comparison = "eq"
+	// OpNotEqual holds if the value is missing, or differs from the Value
+	OpNotEqual Comparison = "ne"
+	// OpLess holds if the value is less than the Value
+	OpLess Comparison = "lt"
+	// OpLessEqual holds if the value is less than, or equal to the Value
+	OpLessEqual Comparison = "le"
+	// OpGreater holds if the value is greater than the Value
+	OpGreater Comparison = "gt"
+	// OpGreaterEqual holds if the value is greater than, or equal to the Value
+	OpGreaterEqual Comparison = "ge"
+)
+
+// Holds evaluates the Condition against the MetaData and Documents. A nil
+// Condition always holds.
+func (c *Condition) Holds(md MetaData, docs Documents) bool {
+	if c == nil {
+		return true
+	}
+
+	if c.MetaData != "" && !c.compare(md) {
+		return false
+	}
+	if (c.Document != "" || c.ContentType != "") && !c.matchDocuments(docs) {
+		return false
+	}
+
+	for i := range c.All {
+		if !c.All[i].Holds(md, docs) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		holds := false
+		for i := range c.Any {
+			if c.Any[i].Holds(md, docs) {
+				holds = true
+				break
+			}
+		}
+		if !holds {
+			return false
+		}
+	}
+	if c.Not != nil && c.Not.Holds(md, docs) {
+		return false
+	}
+
+	return true
+}
+
+// And returns a Condition holding if both conditions hold. Either may be nil.
+func (c *Condition) And(other *Condition) *Condition {
+	switch {
+	case c == nil:
+		return other
+	case other == nil:
+		return c
+	}
+	return &Condition{All: []Condition{*c, *other}}
+}
+
+// Validate reports the problems in the Condition, e.g. unknown operators.
+func (c *Condition) Validate() []string {
+	if c == nil {
+		return nil
+	}
+
+	var problems []string
+	switch c.Op {
+	case "":
+		if c.Value != nil {
+			problems = append(problems, "value without op")
+		}
+	case OpEqual, OpNotEqual, OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		if c.MetaData == "" {
+			problems = append(problems, fmt.Sprintf("op %q without metadata", c.Op))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown op %q", c.Op))
+	}
+
+	if c.ContentType != "" {
+		if _, err := path.Match(c.ContentType, ""); err != nil {
+			problems = append(problems,
+				fmt.Sprintf("bad content_type pattern %q", c.ContentType))
+		}
+	}
+
+	for i := range c.All {
+		problems = append(problems, c.All[i].Validate()...)
+	}
+	for i := range c.Any {
+		problems = append(problems, c.Any[i].Validate()...)
+	}
+	return append(problems, c.Not.Validate()...)
+}
+
+func (c *Condition) compare(md MetaData) bool {
+	v, ok := md[c.MetaData]
+
+	switch c.Op {
+	case "":
+		return ok
+	case OpEqual:
+		return ok && equal(v, c.Value)
+	case OpNotEqual:
+		return !ok || !equal(v, c.Value)
+	}
+	if !ok {
+		return false
+	}
+
+	cmp, ok := order(v, c.Value)
+	if !ok {
+		return false
+	}
+
+	switch c.Op {
+	case OpLess:
+		return cmp < 0
+	case OpLessEqual:
+		return cmp <= 0
+	case OpGreater:
+		return cmp > 0
+	case OpGreaterEqual:
+		return cmp >= 0
+	}
+	return false
+}
+
+func (c *Condition) matchDocuments(docs Documents) bool {
+	if c.Document == "" {
+		for _, doc := range docs {
+			if match(c.ContentType, doc.ContentType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	doc, ok := docs[c.Document]
+	if !ok {
+		return false
+	}
+	return c.ContentType == "" || match(c.ContentType, doc.ContentType)
+}
+
+func match(pattern, contentType string) bool {
+	ok, err := path.Match(pattern, contentType)
+	return err == nil && ok
+}
+
+// equal compares two values, treating all numbers alike, as values decoded from
+// JSON are float64, while values set in code may be ints.
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// order compares two numbers, or two strings. Returns false if the values are
+// not comparable.
+func order(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	x, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+	y, ok := b.(string)
+	switch {
+	case !ok:
+		return 0, false
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,133 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"testing"
+)
+
+func TestConditionHolds(t *testing.T) {
+	md := payload.MetaData{
+		"origin": "producer",
+		"pages":  float64(3),
+		"size":   12,
+	}
+	docs := payload.Documents{
+		"scan": payload.NewDocument("", "image/png", payload.Base64Encoding),
+		"text": payload.NewDocument("", "text/plain", ""),
+	}
+
+	type testCase struct {
+		when  *payload.Condition
+		holds bool
+	}
+
+	for name, tc := range map[string]testCase{
+		"nil":   {nil, true},
+		"empty": {&payload.Condition{}, true},
+		"metadata present": {
+			&payload.Condition{MetaData: "origin"}, true,
+		},
+		"metadata missing": {
+			&payload.Condition{MetaData: "missing"}, false,
+		},
+		"metadata equal": {
+			&payload.Condition{MetaData: "origin", Op: payload.OpEqual, Value: "producer"},
+			true,
+		},
+		"metadata equal number": {
+			&payload.Condition{MetaData: "pages", Op: payload.OpEqual, Value: 3},
+			true,
+		},
+		"metadata not equal missing": {
+			&payload.Condition{MetaData: "missing", Op: payload.OpNotEqual, Value: "x"},
+			true,
+		},
+		"metadata greater": {
+			&payload.Condition{MetaData: "size", Op: payload.OpGreater, Value: 10.5},
+			true,
+		},
+		"metadata less equal": {
+			&payload.Condition{MetaData: "pages", Op: payload.OpLessEqual, Value: 2},
+			false,
+		},
+		"metadata string order": {
+			&payload.Condition{MetaData: "origin", Op: payload.OpLess, Value: "z"},
+			true,
+		},
+		"metadata incomparable": {
+			&payload.Condition{MetaData: "origin", Op: payload.OpGreater, Value: 1},
+			false,
+		},
+		"document present": {
+			&payload.Condition{Document: "scan"}, true,
+		},
+		"document missing": {
+			&payload.Condition{Document: "missing"}, false,
+		},
+		"document content type": {
+			&payload.Condition{Document: "text", ContentType: "image/*"}, false,
+		},
+		"any content type": {
+			&payload.Condition{ContentType: "image/*"}, true,
+		},
+		"no content type": {
+			&payload.Condition{ContentType: "application/pdf"}, false,
+		},
+		"all": {
+			&payload.Condition{All: []payload.Condition{
+				{MetaData: "origin"},
+				{Document: "missing"},
+			}},
+			false,
+		},
+		"any": {
+			&payload.Condition{Any: []payload.Condition{
+				{MetaData: "missing"},
+				{Document: "scan"},
+			}},
+			true,
+		},
+		"not": {
+			&payload.Condition{Not: &payload.Condition{ContentType: "image/*"}},
+			false,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if holds := tc.when.Holds(md, docs); holds != tc.holds {
+				t.Errorf("Unexpected outcome. Have %v, want %v.", holds, tc.holds)
+			}
+		})
+	}
+}
+
+func TestConditionValidate(t *testing.T) {
+	type testCase struct {
+		when     *payload.Condition
+		problems int
+	}
+
+	for name, tc := range map[string]testCase{
+		"nil":     {nil, 0},
+		"valid":   {&payload.Condition{MetaData: "a", Op: payload.OpEqual, Value: 1}, 0},
+		"unknown": {&payload.Condition{MetaData: "a", Op: "like", Value: 1}, 1},
+		"no key":  {&payload.Condition{Op: payload.OpEqual, Value: 1}, 1},
+		"no op":   {&payload.Condition{MetaData: "a", Value: 1}, 1},
+		"pattern": {&payload.Condition{ContentType: "image/["}, 1},
+		"nested": {
+			&payload.Condition{
+				All: []payload.Condition{{Op: "like"}},
+				Not: &payload.Condition{Value: 1},
+			},
+			2,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if problems := tc.when.Validate(); len(problems) != tc.problems {
+				t.Errorf("Unexpected problems. Have %q, want %d.", problems, tc.problems)
+			}
+		})
+	}
+}
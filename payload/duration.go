@@ -0,0 +1,39 @@
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration which is represented in JSON as a human readable
+// string, e.g. "1m30s". A plain number is interpreted as seconds.
+type Duration time.Duration
+
+// MarshalJSON encodes the Duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes the Duration from a string, or a number of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+
+	return nil
+}
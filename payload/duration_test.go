@@ -0,0 +1,57 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var durationCases = []struct {
+	Name     string
+	JSON     string
+	Expected payload.Duration
+	Error    bool
+}{
+	{"String", `"1m30s"`, payload.Duration(90 * time.Second), false},
+	{"Seconds", `2.5`, payload.Duration(2500 * time.Millisecond), false},
+	{"Bad string", `"soon"`, 0, true},
+	{"Bad type", `true`, 0, true},
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	for _, tc := range durationCases {
+		tc := tc // capture range variable
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var d payload.Duration
+			err := json.Unmarshal([]byte(tc.JSON), &d)
+			if tc.Error {
+				if err == nil {
+					t.Errorf("Expected error, got %v", d)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+			if d != tc.Expected {
+				t.Errorf("Unexpected duration. Have %v, want %v.",
+					time.Duration(d), time.Duration(tc.Expected))
+			}
+		})
+	}
+}
+
+func TestDurationMarshal(t *testing.T) {
+	b, err := json.Marshal(payload.Duration(90 * time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if string(b) != `"1m30s"` {
+		t.Errorf("Unexpected JSON. Have %s, want %s.", b, `"1m30s"`)
+	}
+}
@@ -3,17 +3,19 @@ package payload
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// Message is a simple example message
+// Message is a simple example message. A Message on a branch of a scatter step
+// is marked with the Branch.
 type Message struct {
 	Routing   `json:"routing"`
 	TraceID   string `json:"trace_id"`
 	MetaData  `json:"metadata,omitempty"`
 	Documents `json:"documents,omitempty"`
+	Branch    *Branch `json:"branch,omitempty"`
 }
 
 // Routing contains the routing name, slip, and current step number.
@@ -23,28 +25,56 @@ type Routing struct {
 	Slip     []Step `json:"slip"`
 }
 
-// Step is a single processing step in a routing slip
+// Step is a single processing step in a routing slip. The optional Timeout
+// limits how long the step may take, before it is considered failed. A step
+// with a When condition is skipped if the condition does not hold. A step with
+// a Scatter is handled by the aggregator on the Queue. A step with a Route,
+// instead of a Queue, is replaced by the steps of that route, see Routes.Route.
+// The Compensate queue undoes the step, should a later step fail for good.
 type Step struct {
 	Queue         string `json:"queue"`
+	Route         string `json:"route,omitempty"`
 	Arguments     `json:"arguments,omitempty"`
 	ErrorHandling `json:"on_error,omitempty"`
-	Log           []string `json:"log,omitempty"`
+	Timeout       Duration   `json:"timeout,omitempty"`
+	When          *Condition `json:"when,omitempty"`
+	Scatter       *Scatter   `json:"scatter,omitempty"`
+	Compensate    string     `json:"compensate,omitempty"`
+	Skipped       bool       `json:"skipped,omitempty"`
+	Log           []string   `json:"log,omitempty"`
 }
 
 // Arguments is a set of key-value pairs containing arguments specific to a Step
 type Arguments map[string]interface{}
 
 // ErrorHandling declares how failed steps are to be handled. Currently focusses
-// on retry limits, and (partially) rewinding the route position.
+// on retry limits, (partially) rewinding the route position, the backoff
+// between retries, and the dead-letter queue for messages failing for good.
 type ErrorHandling struct {
-	MaxRetries int `json:"max_retries"`
-	Attempt    int `json:"attempt,omitempty"`
-	Rewind     int `json:"rewind,omitempty"`
+	MaxRetries int      `json:"max_retries"`
+	Attempt    int      `json:"attempt,omitempty"`
+	Rewind     int      `json:"rewind,omitempty"`
+	Backoff    *Backoff `json:"backoff,omitempty"`
+	DeadLetter string   `json:"dead_letter,omitempty"`
+}
+
+// RetryDelay returns how long to wait before retrying the next attempt.
+func (eh ErrorHandling) RetryDelay() time.Duration {
+	return eh.Backoff.Delay(eh.Attempt)
 }
 
 // MetaData is a set of key-value pairs containing general information about a Message
 type MetaData map[string]interface{}
 
+const (
+	// DeadLetterError is the MetaData key holding the error for which a
+	// Message was dead-lettered.
+	DeadLetterError = "dead_letter_error"
+	// DeadLetterTime is the MetaData key holding the RFC 3339 time at which a
+	// Message was dead-lettered.
+	DeadLetterTime = "dead_letter_time"
+)
+
 // MessageFromByteSlice unmarshals a JSON byte slice into a Message.
 func MessageFromByteSlice(b []byte) (*Message, error) {
 	var msg Message
@@ -55,15 +85,11 @@ func MessageFromByteSlice(b []byte) (*Message, error) {
 }
 
 // NewMessage creates a new Message with a unique TraceID, and attaches the
-// routing slip, metadatam and documents.
+// routing slip, metadatam and documents. Like uuid.New, it panics if no random
+// TraceID can be generated.
 func NewMessage(route Routing, meta MetaData, docs Documents) Message {
-	traceID, err := uuid.NewUUID()
-	if err != nil {
-		log.Fatalf("could not create UUID: %v", err)
-	}
-
 	return Message{
-		TraceID:   traceID.String(),
+		TraceID:   uuid.New().String(),
 		Routing:   route,
 		MetaData:  meta,
 		Documents: docs,
@@ -71,19 +97,15 @@ func NewMessage(route Routing, meta MetaData, docs Documents) Message {
 }
 
 // NewMessageForRoute creates a new Message with a unique TraceID to send to the
-// post-office for the route by name.
+// post-office for the route by name. Like uuid.New, it panics if no random
+// TraceID can be generated.
 func NewMessageForRoute(route string, meta MetaData, docs Documents) Message {
-	traceID, err := uuid.NewUUID()
-	if err != nil {
-		log.Fatalf("could not create UUID: %v", err)
-	}
-
 	return Message{
-		TraceID: traceID.String(),
+		TraceID: uuid.New().String(),
 		Routing: Routing{
 			Name: route,
 			Slip: []Step{
-				{Queue: "post-office"},
+				{Queue: PostOffice},
 			},
 		},
 		MetaData:  meta,
@@ -101,34 +123,73 @@ func (msg Message) CurrentStep() (*Step, error) {
 }
 
 // Advance creates a new Message based on the current message, but with updated
-// documents and advanced routing position. Returns nil if there is no next step.
+// documents and advanced routing position. Steps whose condition does not hold
+// are marked as skipped. Returns nil if there is no next step.
 func (msg Message) Advance(pl *Documents, md *MetaData) (*Message, error) {
 	if msg.Routing.Position < 0 {
 		return nil, fmt.Errorf("dropping invalid message at step %d / %d",
 			msg.Routing.Position+1, len(msg.Routing.Slip))
 	}
-	if msg.Routing.Position+1 >= len(msg.Routing.Slip) {
-		log.Printf("At step %d / %d. Finished route...", msg.Routing.Position+1, len(msg.Routing.Slip))
-		return nil, nil
-	}
 
-	log.Printf("Advancing to step %d / %d. Still enroute...", msg.Routing.Position+2, len(msg.Routing.Slip))
-
-	return &Message{
+	next := &Message{
 		Routing: Routing{
 			Name:     msg.Routing.Name,
-			Position: msg.Routing.Position + 1,
+			Position: msg.Routing.Position,
 			Slip:     msg.Slip,
 		},
 		TraceID:   msg.TraceID,
 		MetaData:  msg.combineMetaData(md),
 		Documents: msg.combineDocuments(pl),
-	}, nil
+		Branch:    msg.Branch,
+	}
+
+	if !next.skipTo(msg.Routing.Position + 1) {
+		return nil, nil
+	}
+	return next, nil
+}
+
+// Begin positions a copy of the message at the first step of the slip whose
+// condition holds. Returns nil if no step applies.
+func (msg Message) Begin() *Message {
+	next := msg
+	if !next.skipTo(0) {
+		return nil
+	}
+	return &next
+}
+
+// skipTo moves the position to the first step, starting from the position
+// given, whose condition holds. Steps passed over are marked as skipped in a
+// copy of the slip, and a step no longer skipped is unmarked. Returns false if
+// no step applies.
+func (msg *Message) skipTo(position int) bool {
+	copied := false
+	for ; position < len(msg.Routing.Slip); position++ {
+		step := msg.Routing.Slip[position]
+		holds := step.When.Holds(msg.MetaData, msg.Documents)
+
+		if step.Skipped == holds {
+			if !copied {
+				slip := make([]Step, len(msg.Routing.Slip))
+				copy(slip, msg.Routing.Slip)
+				msg.Routing.Slip, copied = slip, true
+			}
+			msg.Routing.Slip[position].Skipped = !holds
+		}
+
+		if holds {
+			msg.Routing.Position = position
+			return true
+		}
+	}
+	return false
 }
 
 // Retry creates a new Message based on the current message, but with updated
 // attempt count, and possibly a partially reset Position. Returns nil if the
-// number of retries has been exhausted.
+// number of retries has been exhausted, or an error if the step cannot be
+// retried as configured.
 func (msg Message) Retry(e error) (*Message, error) {
 	step, err := msg.CurrentStep()
 	if err != nil {
@@ -136,35 +197,94 @@ func (msg Message) Retry(e error) (*Message, error) {
 	}
 
 	if step.Attempt >= step.MaxRetries {
-		log.Printf("At attempt %d / %d. Giving up...", step.Attempt+1, step.MaxRetries+1)
 		return nil, nil
 	}
-
 	if step.Rewind < 0 {
-		log.Printf("Rewind must be positive. Dropping invalid route...")
-		return nil, nil
+		return nil, fmt.Errorf("invalid negative rewind %d at step %d / %d",
+			step.Rewind, msg.Routing.Position+1, len(msg.Routing.Slip))
 	}
-
 	if msg.Routing.Position-step.Rewind < 0 {
-		log.Printf("Rewinding beyond begining. Dropping invalid route...")
-		return nil, nil
+		return nil, fmt.Errorf("invalid rewind %d past the start at step %d / %d",
+			step.Rewind, msg.Routing.Position+1, len(msg.Routing.Slip))
 	}
 
-	log.Printf("Retrying step %d / %d. Still enroute...",
-		msg.Routing.Position-step.Rewind+1, len(msg.Routing.Slip))
-
 	step.Attempt++
 	step.Log = append(step.Log, e.Error())
 
-	return &Message{
+	next := &Message{
 		Routing: Routing{
 			Name:     msg.Routing.Name,
-			Position: msg.Routing.Position - step.Rewind,
+			Position: msg.Routing.Position,
 			Slip:     msg.Slip,
 		},
 		TraceID:   msg.TraceID,
 		MetaData:  msg.MetaData,
 		Documents: msg.Documents,
+		Branch:    msg.Branch,
+	}
+	// Rewound steps are skipped again if their condition no longer holds.
+	next.skipTo(msg.Routing.Position - step.Rewind)
+	return next, nil
+}
+
+// DeadLetter creates a copy of the message to park on a dead-letter queue. The
+// error is appended to the Log of the current step, and recorded in the
+// MetaData along with the time, while the routing position is kept as is.
+func (msg Message) DeadLetter(e error) Message {
+	slip := make([]Step, len(msg.Routing.Slip))
+	copy(slip, msg.Routing.Slip)
+
+	if pos := msg.Routing.Position; pos >= 0 && pos < len(slip) {
+		slip[pos].Log = append(append([]string{}, slip[pos].Log...), e.Error())
+	}
+
+	return Message{
+		Routing: Routing{
+			Name:     msg.Routing.Name,
+			Position: msg.Routing.Position,
+			Slip:     slip,
+		},
+		TraceID: msg.TraceID,
+		MetaData: msg.combineMetaData(&MetaData{
+			DeadLetterError: e.Error(),
+			DeadLetterTime:  time.Now().UTC().Format(time.RFC3339Nano),
+		}),
+		Documents: msg.Documents,
+		Branch:    msg.Branch,
+	}
+}
+
+// Replay creates a copy of a dead-lettered message, ready to be sent to the
+// step at its current position again. The dead-letter metadata is removed, and
+// optionally the attempts of the current step are reset.
+func (msg Message) Replay(resetAttempt bool) (*Message, error) {
+	if _, err := msg.CurrentStep(); err != nil {
+		return nil, err
+	}
+
+	slip := make([]Step, len(msg.Routing.Slip))
+	copy(slip, msg.Routing.Slip)
+	if resetAttempt {
+		slip[msg.Routing.Position].Attempt = 0
+	}
+
+	md := MetaData{}
+	for k, v := range msg.MetaData {
+		md[k] = v
+	}
+	delete(md, DeadLetterError)
+	delete(md, DeadLetterTime)
+
+	return &Message{
+		Routing: Routing{
+			Name:     msg.Routing.Name,
+			Position: msg.Routing.Position,
+			Slip:     slip,
+		},
+		TraceID:   msg.TraceID,
+		MetaData:  md,
+		Documents: msg.Documents,
+		Branch:    msg.Branch,
 	}, nil
 }
 
@@ -323,6 +323,88 @@ func TestAdvance(t *testing.T) {
 	}
 }
 
+func TestAdvanceConditional(t *testing.T) {
+	images := &payload.Condition{ContentType: "image/*"}
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-conditional",
+			Slip: []payload.Step{
+				{Queue: "start"},
+				{Queue: "ocr", When: images},
+				{Queue: "index"},
+				{Queue: "thumbnail", When: images},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{
+			"doc": payload.NewDocument("test", "text/plain", ""),
+		},
+	)
+
+	next, err := msg.Advance(nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if next == nil {
+		t.Fatalf("Expected next message, got nil")
+	}
+	if next.Routing.Position != 2 {
+		t.Errorf("Expected skipped step. Have position %d, want %d.",
+			next.Routing.Position, 2)
+	}
+	if !next.Routing.Slip[1].Skipped {
+		t.Errorf("Expected step 1 to be marked skipped: %+v", next.Routing.Slip[1])
+	}
+	if msg.Routing.Slip[1].Skipped {
+		t.Errorf("Original slip modified: %+v", msg.Routing.Slip[1])
+	}
+
+	last, err := next.Advance(nil, nil)
+	if err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if last != nil {
+		t.Errorf("Expected route to finish, got %+v", last)
+	}
+
+	next, err = msg.Advance(&payload.Documents{
+		"scan": payload.NewDocument("", "image/png", payload.Base64Encoding),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if next == nil || next.Routing.Position != 1 {
+		t.Errorf("Expected condition to hold, got %+v", next)
+	}
+}
+
+func TestBegin(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-begin",
+			Slip: []payload.Step{
+				{Queue: "first", When: &payload.Condition{MetaData: "first"}},
+				{Queue: "second", When: &payload.Condition{MetaData: "second"}},
+			},
+		},
+		payload.MetaData{"second": true},
+		payload.Documents{},
+	)
+
+	next := msg.Begin()
+	if next == nil {
+		t.Fatalf("Expected a message, got nil")
+	}
+	if next.Routing.Position != 1 {
+		t.Errorf("Unexpected position. Have %d, want %d.", next.Routing.Position, 1)
+	}
+
+	msg.MetaData = payload.MetaData{}
+	if next = msg.Begin(); next != nil {
+		t.Errorf("Expected no applicable step, got %+v", next)
+	}
+}
+
 func TestRetry(t *testing.T) {
 	msg := payload.NewMessage(
 		payload.Routing{
@@ -353,13 +435,15 @@ func TestRetry(t *testing.T) {
 
 	// retry configured, but invalid rewind
 	msg.Routing.Slip[1].MaxRetries = 3
-	msg.Routing.Slip[1].Rewind = 2
-	retry, err = msg.Retry(e)
-	if err != nil {
-		t.Errorf("Unexpected error: %+v", err)
-	}
-	if retry != nil {
-		t.Errorf("Unexpected retry message: %+v", retry)
+	for _, rewind := range []int{-1, 2} {
+		msg.Routing.Slip[1].Rewind = rewind
+		retry, err = msg.Retry(e)
+		if err == nil {
+			t.Errorf("Expected error for invalid rewind %d, got nil", rewind)
+		}
+		if retry != nil {
+			t.Errorf("Unexpected retry message: %+v", retry)
+		}
 	}
 
 	// maxed out attempts
@@ -412,3 +496,114 @@ func TestRetry(t *testing.T) {
 		}
 	}
 }
+
+func TestDeadLetter(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-dead-letter",
+			Position: 1,
+			Slip: []payload.Step{
+				{Queue: "back"},
+				{
+					Queue: "again",
+					Log:   []string{"first"},
+				},
+			},
+		},
+		payload.MetaData{
+			"meta": "data",
+		},
+		payload.Documents{
+			"doc": payload.NewDocument("test", "text/plain", ""),
+		},
+	)
+
+	dead := msg.DeadLetter(fmt.Errorf("last"))
+
+	if dead.TraceID != msg.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", dead.TraceID, msg.TraceID)
+	}
+	if dead.Routing.Position != 1 {
+		t.Errorf("Position changed. Have %d, want %d.", dead.Routing.Position, 1)
+	}
+
+	log := dead.Routing.Slip[1].Log
+	if len(log) != 2 || log[0] != "first" || log[1] != "last" {
+		t.Errorf("Unexpected log. Have %+v, want %+v.", log, []string{"first", "last"})
+	}
+	if len(msg.Routing.Slip[1].Log) != 1 {
+		t.Errorf("Original log modified. Have %+v.", msg.Routing.Slip[1].Log)
+	}
+
+	if e, ok := dead.MetaData[payload.DeadLetterError]; !ok || e != "last" {
+		t.Errorf("Unexpected %q metadata. Have %+v, want %q.",
+			payload.DeadLetterError, e, "last")
+	}
+	if _, ok := dead.MetaData[payload.DeadLetterTime]; !ok {
+		t.Errorf("Missing %q metadata in %+v.", payload.DeadLetterTime, dead.MetaData)
+	}
+	if m, ok := dead.MetaData["meta"]; !ok || m != "data" {
+		t.Errorf("Unexpected 'meta' metadata. Want %q, have %+v", "data", m)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-replay",
+			Position: 1,
+			Slip: []payload.Step{
+				{Queue: "back"},
+				{
+					Queue:         "again",
+					ErrorHandling: payload.ErrorHandling{MaxRetries: 3, Attempt: 3},
+				},
+			},
+		},
+		payload.MetaData{
+			"meta": "data",
+		},
+		payload.Documents{},
+	).DeadLetter(fmt.Errorf("example"))
+
+	replay, err := msg.Replay(false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if replay.Routing.Slip[1].Attempt != 3 {
+		t.Errorf("Unexpected attempt. Have %d, want %d.",
+			replay.Routing.Slip[1].Attempt, 3)
+	}
+
+	replay, err = msg.Replay(true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if replay.Routing.Slip[1].Attempt != 0 {
+		t.Errorf("Unexpected attempt. Have %d, want %d.",
+			replay.Routing.Slip[1].Attempt, 0)
+	}
+	if msg.Routing.Slip[1].Attempt != 3 {
+		t.Errorf("Original attempt modified. Have %d.", msg.Routing.Slip[1].Attempt)
+	}
+	if replay.Routing.Position != 1 {
+		t.Errorf("Unexpected position. Have %d, want %d.", replay.Routing.Position, 1)
+	}
+	if replay.TraceID != msg.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", replay.TraceID, msg.TraceID)
+	}
+
+	for _, key := range []string{payload.DeadLetterError, payload.DeadLetterTime} {
+		if _, ok := replay.MetaData[key]; ok {
+			t.Errorf("Unexpected %q metadata in %+v.", key, replay.MetaData)
+		}
+	}
+	if m, ok := replay.MetaData["meta"]; !ok || m != "data" {
+		t.Errorf("Unexpected 'meta' metadata. Want %q, have %+v", "data", m)
+	}
+
+	msg.Routing.Position = 2
+	if _, err = msg.Replay(true); err == nil {
+		t.Errorf("Expected error for invalid position, got nil")
+	}
+}
@@ -0,0 +1,56 @@
+package payload
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// Ping is the MetaData key marking a ping Message, which Components advance
+	// without processing it.
+	Ping = "ping"
+	// PingHops is the MetaData key listing the Hops of a ping Message.
+	PingHops = "ping_hops"
+)
+
+// Hop records the time at which a ping Message passed a step.
+type Hop struct {
+	Position int       `json:"position"`
+	Queue    string    `json:"queue"`
+	Time     time.Time `json:"time"`
+}
+
+// Hops returns the Hops recorded in the MetaData.
+func (msg Message) Hops() []Hop {
+	var hops []Hop
+
+	raw, ok := msg.MetaData[PingHops]
+	if !ok {
+		return hops
+	}
+	// Decoded from JSON, the hops are generic maps
+	b, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(b, &hops)
+	}
+	if err != nil {
+		return nil
+	}
+	return hops
+}
+
+// Hop returns the MetaData update recording the current step as passed at the
+// time given.
+func (msg Message) Hop(t time.Time) *MetaData {
+	hop := Hop{
+		Position: msg.Routing.Position,
+		Time:     t.UTC(),
+	}
+	if step, err := msg.CurrentStep(); err == nil {
+		hop.Queue = step.Queue
+	}
+
+	return &MetaData{
+		PingHops: append(msg.Hops(), hop),
+	}
+}
@@ -0,0 +1,58 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHops(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-ping",
+			Slip: []payload.Step{{Queue: "foo"}, {Queue: "bar"}},
+		},
+		payload.MetaData{payload.Ping: true},
+		payload.Documents{},
+	)
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if hops := msg.Hops(); len(hops) != 0 {
+		t.Errorf("Unexpected hops: %+v", hops)
+	}
+
+	next, err := msg.Advance(nil, msg.Hop(first))
+	if err != nil || next == nil {
+		t.Fatalf("Failed to advance: %+v, %+v", next, err)
+	}
+
+	// Hops survive a round trip through JSON
+	b, err := json.Marshal(next)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	next, err = payload.MessageFromByteSlice(b)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	for k, v := range *next.Hop(first.Add(time.Second)) {
+		next.MetaData[k] = v
+	}
+
+	hops := next.Hops()
+	want := []payload.Hop{
+		{Position: 0, Queue: "foo", Time: first},
+		{Position: 1, Queue: "bar", Time: first.Add(time.Second)},
+	}
+	if len(hops) != len(want) {
+		t.Fatalf("Unexpected hops. Have %+v, want %+v.", hops, want)
+	}
+	for i := range want {
+		if hops[i].Position != want[i].Position || hops[i].Queue != want[i].Queue ||
+			!hops[i].Time.Equal(want[i].Time) {
+			t.Errorf("Unexpected hop %d. Have %+v, want %+v.", i, hops[i], want[i])
+		}
+	}
+}
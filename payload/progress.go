@@ -0,0 +1,54 @@
+package payload
+
+import (
+	"time"
+)
+
+// ProgressQueue is the MetaData key naming the queue to which Components
+// publish a Progress event after every step.
+const ProgressQueue = "progress_queue"
+
+// ProgressStatus is the outcome of a step reported in a Progress event.
+type ProgressStatus string
+
+const (
+	// ProgressDone means the step completed, and the message advanced
+	ProgressDone ProgressStatus = "done"
+	// ProgressRetrying means the step failed, and will be retried
+	ProgressRetrying ProgressStatus = "retrying"
+	// ProgressFailed means the step failed for good
+	ProgressFailed ProgressStatus = "failed"
+)
+
+// Progress is a lightweight event describing the outcome of a single step of
+// the route of a Message.
+type Progress struct {
+	TraceID  string         `json:"trace_id"`
+	Route    string         `json:"route"`
+	Position int            `json:"position"`
+	Steps    int            `json:"steps"`
+	Queue    string         `json:"queue"`
+	Status   ProgressStatus `json:"status"`
+	Duration Duration       `json:"duration"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Progress creates the Progress event for the step at the current position,
+// which took the duration given, and failed with the error, if not nil.
+func (msg Message) Progress(status ProgressStatus, d time.Duration, e error) Progress {
+	p := Progress{
+		TraceID:  msg.TraceID,
+		Route:    msg.Routing.Name,
+		Position: msg.Routing.Position,
+		Steps:    len(msg.Routing.Slip),
+		Status:   status,
+		Duration: Duration(d),
+	}
+	if step, err := msg.CurrentStep(); err == nil {
+		p.Queue = step.Queue
+	}
+	if e != nil {
+		p.Error = e.Error()
+	}
+	return p
+}
@@ -0,0 +1,40 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name:     "test-progress",
+			Position: 1,
+			Slip: []payload.Step{
+				{Queue: "foo"},
+				{Queue: "bar"},
+				{Queue: "baz"},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+
+	p := msg.Progress(payload.ProgressRetrying, 2*time.Second, fmt.Errorf("example"))
+	want := payload.Progress{
+		TraceID:  msg.TraceID,
+		Route:    "test-progress",
+		Position: 1,
+		Steps:    3,
+		Queue:    "bar",
+		Status:   payload.ProgressRetrying,
+		Duration: payload.Duration(2 * time.Second),
+		Error:    "example",
+	}
+	if p != want {
+		t.Errorf("Unexpected progress. Have %+v, want %+v.", p, want)
+	}
+}
@@ -0,0 +1,185 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PostOffice is the queue of the post-office, which resolves the routing slip
+// for messages created for a route by name.
+const PostOffice = "post-office"
+
+// Routes is a set of named route definitions.
+type Routes map[string]Routing
+
+// routeExtensions are the file extensions of route definition files.
+var routeExtensions = map[string]bool{
+	".json": true,
+	".yaml": true,
+	".yml":  true,
+}
+
+// LoadRoutes reads the route definitions from a YAML or JSON file, or from all
+// such files in a directory. Every file contains a list of routes, each with a
+// unique name.
+func LoadRoutes(path string) (Routes, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = files[:0]
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if !entry.IsDir() && routeExtensions[ext] {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	routes := Routes{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := ParseRoutes(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		for name, route := range parsed {
+			if _, ok := routes[name]; ok {
+				return nil, fmt.Errorf("%s: duplicate route %q", file, name)
+			}
+			routes[name] = route
+		}
+	}
+
+	// Sub-routes may be defined in any of the files.
+	for name := range routes {
+		if _, err := routes.Route(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return routes, nil
+}
+
+// ParseRoutes decodes a list of route definitions from YAML or JSON data. Both
+// unknown fields, and routes failing validation, are reported as errors.
+func ParseRoutes(data []byte) (Routes, error) {
+	// YAML is a superset of JSON, and converting it to JSON reuses the json
+	// tags of the Routing types.
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Routing
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+
+	routes := Routes{}
+	for _, route := range list {
+		if err := route.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := routes[route.Name]; ok {
+			return nil, fmt.Errorf("duplicate route %q", route.Name)
+		}
+		routes[route.Name] = route
+	}
+	return routes, nil
+}
+
+// Route returns a copy of the route by name, positioned at the first step. The
+// steps referencing a sub-route are replaced by the steps of that sub-route, and
+// the Rewind of the other steps is adjusted to still rewind to the same step,
+// or to the start of a sub-route replacing it.
+func (rs Routes) Route(name string) (Routing, error) {
+	slip, err := rs.expand(name, nil)
+	if err != nil {
+		return Routing{}, err
+	}
+
+	return Routing{
+		Name:     name,
+		Position: 0,
+		Slip:     slip,
+	}, nil
+}
+
+// expand returns a copy of the slip of the route by name, with all sub-routes
+// expanded. The parents are the routes being expanded, to detect cycles.
+func (rs Routes) expand(name string, parents []string) ([]Step, error) {
+	for _, parent := range parents {
+		if parent == name {
+			return nil, fmt.Errorf("cyclic sub-route %s",
+				strings.Join(append(parents, name), " -> "))
+		}
+	}
+	parents = append(parents[:len(parents):len(parents)], name)
+
+	route, ok := rs[name]
+	if !ok {
+		if len(parents) > 1 {
+			return nil, fmt.Errorf("unknown sub-route %q in %q", name, parents[len(parents)-2])
+		}
+		return nil, fmt.Errorf("unknown route %q", name)
+	}
+
+	var slip []Step
+	// start is the position in the expanded slip of every original step
+	start := make([]int, len(route.Slip))
+
+	for i, step := range route.Slip {
+		start[i] = len(slip)
+		if step.Route == "" {
+			slip = append(slip, step)
+			continue
+		}
+
+		sub, err := rs.expand(step.Route, parents)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sub {
+			s.When = step.When.And(s.When)
+			slip = append(slip, s)
+		}
+	}
+
+	for i, step := range route.Slip {
+		if step.Route != "" || step.Rewind <= 0 || step.Rewind > i {
+			continue
+		}
+		slip[start[i]].Rewind = start[i] - start[i-step.Rewind]
+	}
+
+	return slip, nil
+}
@@ -0,0 +1,225 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const yamlRoutes = `
+- name: demo
+  slip:
+    - queue: foo
+      arguments:
+        duration: 1s
+      on_error:
+        max_retries: 3
+    - queue: bar
+      when:
+        metadata: pages
+        op: gt
+        value: 1
+`
+
+const jsonRoutes = `[
+	{
+		"name": "other",
+		"slip": [
+			{"queue": "baz"}
+		]
+	}
+]`
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := payload.ParseRoutes([]byte(yamlRoutes))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	route, ok := routes["demo"]
+	if !ok {
+		t.Fatalf("Missing route 'demo' in %+v.", routes)
+	}
+	if len(route.Slip) != 2 {
+		t.Fatalf("Unexpected slip length. Have %d, want %d.", len(route.Slip), 2)
+	}
+	if route.Slip[0].Queue != "foo" || route.Slip[1].Queue != "bar" {
+		t.Errorf("Unexpected slip queues in %+v.", route.Slip)
+	}
+	if route.Slip[0].MaxRetries != 3 {
+		t.Errorf("Unexpected max retries. Have %d, want %d.", route.Slip[0].MaxRetries, 3)
+	}
+	if route.Slip[0].Arguments["duration"] != "1s" {
+		t.Errorf("Unexpected arguments: %+v.", route.Slip[0].Arguments)
+	}
+	if w := route.Slip[1].When; w == nil || w.Op != payload.OpGreater || w.Value != 1.0 {
+		t.Errorf("Unexpected condition: %+v.", w)
+	}
+
+	routes, err = payload.ParseRoutes([]byte(jsonRoutes))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if _, ok := routes["other"]; !ok {
+		t.Errorf("Missing route 'other' in %+v.", routes)
+	}
+
+	_, err = payload.ParseRoutes([]byte(yamlRoutes + yamlRoutes[1:]))
+	if err == nil {
+		t.Errorf("Expected duplicate route error, got nil")
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"demo.yaml":  yamlRoutes,
+		"other.json": jsonRoutes,
+		"README.md":  "Not a route",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routes, err := payload.LoadRoutes(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if len(routes) != 2 {
+		t.Errorf("Unexpected number of routes. Have %d, want %d.", len(routes), 2)
+	}
+
+	routes, err = payload.LoadRoutes(filepath.Join(dir, "demo.yaml"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if len(routes) != 1 {
+		t.Errorf("Unexpected number of routes. Have %d, want %d.", len(routes), 1)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "copy.yml"), []byte(yamlRoutes), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payload.LoadRoutes(dir); err == nil {
+		t.Errorf("Expected duplicate route error, got nil")
+	}
+
+	if _, err = payload.LoadRoutes(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected missing file error, got nil")
+	}
+}
+
+func TestRoutesRoute(t *testing.T) {
+	routes, err := payload.ParseRoutes([]byte(yamlRoutes))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	route, err := routes.Route("demo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	route.Slip[0].Queue = "changed"
+	if routes["demo"].Slip[0].Queue != "foo" {
+		t.Errorf("Route definition modified through copy: %+v", routes["demo"])
+	}
+
+	if _, err = routes.Route("missing"); err == nil {
+		t.Errorf("Expected unknown route error, got nil")
+	}
+}
+
+const subRoutes = `
+- name: ingest
+  slip:
+    - queue: normalize
+    - queue: virus-scan
+    - queue: thumbnail
+      on_error:
+        max_retries: 1
+        rewind: 2
+- name: upload
+  slip:
+    - queue: receive
+    - route: ingest
+      when:
+        document: upload
+    - queue: store
+      on_error:
+        max_retries: 1
+        rewind: 1
+    - queue: notify
+      on_error:
+        max_retries: 1
+        rewind: 3
+`
+
+func TestRoutesSubRoute(t *testing.T) {
+	routes, err := payload.ParseRoutes([]byte(subRoutes))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	route, err := routes.Route("upload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	type expect struct {
+		queue  string
+		rewind int
+		when   bool
+	}
+	want := []expect{
+		{"receive", 0, false},
+		{"normalize", 0, true},
+		{"virus-scan", 0, true},
+		{"thumbnail", 2, true},
+		{"store", 3, false},
+		{"notify", 5, false},
+	}
+	if len(route.Slip) != len(want) {
+		t.Fatalf("Unexpected slip length. Have %d, want %d.", len(route.Slip), len(want))
+	}
+	for i, w := range want {
+		step := route.Slip[i]
+		if step.Queue != w.queue || step.Rewind != w.rewind || (step.When != nil) != w.when {
+			t.Errorf("Unexpected step %d. Have %q rewind %d when %v, want %+v.",
+				i, step.Queue, step.Rewind, step.When != nil, w)
+		}
+	}
+
+	if err = route.Validate(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if routes["upload"].Slip[2].Rewind != 1 {
+		t.Errorf("Route definition modified by expansion: %+v", routes["upload"])
+	}
+}
+
+func TestRoutesSubRouteErrors(t *testing.T) {
+	routes := payload.Routes{
+		"a": {Name: "a", Slip: []payload.Step{{Route: "b"}}},
+		"b": {Name: "b", Slip: []payload.Step{{Queue: "foo"}, {Route: "a"}}},
+		"c": {Name: "c", Slip: []payload.Step{{Route: "missing"}}},
+	}
+
+	if _, err := routes.Route("a"); err == nil {
+		t.Errorf("Expected cyclic sub-route error, got nil")
+	}
+	if _, err := routes.Route("c"); err == nil {
+		t.Errorf("Expected unknown sub-route error, got nil")
+	}
+}
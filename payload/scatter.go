@@ -0,0 +1,139 @@
+package payload
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scatter fans a Message out to several branches in parallel. The aggregator
+// on the Queue of the scatter step sends a copy of the Message to every branch,
+// and gathers the results. Once all branches, or the Quorum, have returned, or
+// the Timeout expires, the merged results advance the original slip.
+type Scatter struct {
+	Branches []Step   `json:"branches"`
+	Quorum   int      `json:"quorum,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+// Required returns the number of branches to wait for.
+func (s Scatter) Required() int {
+	if s.Quorum > 0 && s.Quorum < len(s.Branches) {
+		return s.Quorum
+	}
+	return len(s.Branches)
+}
+
+func (s Scatter) validate() []string {
+	var problems []string
+	if len(s.Branches) == 0 {
+		problems = append(problems, "no branches")
+	}
+	if s.Quorum < 0 || s.Quorum > len(s.Branches) {
+		problems = append(problems, fmt.Sprintf("quorum %d outside of branches", s.Quorum))
+	}
+	if s.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("negative timeout %s", time.Duration(s.Timeout)))
+	}
+
+	for i, branch := range s.Branches {
+		if strings.TrimSpace(branch.Queue) == "" {
+			problems = append(problems, fmt.Sprintf("branch %d: empty queue name", i))
+		}
+		if branch.Route != "" {
+			problems = append(problems, fmt.Sprintf("branch %d: sub-route not supported", i))
+		}
+		if branch.Rewind != 0 {
+			problems = append(problems, fmt.Sprintf("branch %d: rewind %d past the start of the branch", i, branch.Rewind))
+		}
+		if branch.Scatter != nil {
+			problems = append(problems, fmt.Sprintf("branch %d: nested scatter", i))
+		}
+		for _, problem := range branch.When.Validate() {
+			problems = append(problems, fmt.Sprintf("branch %d: when: %s", i, problem))
+		}
+		for _, problem := range branch.Backoff.validate() {
+			problems = append(problems, fmt.Sprintf("branch %d: backoff: %s", i, problem))
+		}
+	}
+	return problems
+}
+
+// Branch marks a Message sent along one of the branches of a scatter step. The
+// ID identifies the scatter by the TraceID and position of the Message, and
+// Index the branch. A Message marked as Timeout
+// expires the scatter instead.
+type Branch struct {
+	ID      string `json:"id"`
+	Index   int    `json:"index"`
+	Timeout bool   `json:"timeout,omitempty"`
+}
+
+// GatherMissing is the MetaData key listing the indices of the branches which
+// had not returned when the results were gathered.
+const GatherMissing = "gather_missing"
+
+// Scatter creates a Message for every branch of the scatter step at the current
+// position. Each branch Message has a slip of the branch step, followed by the
+// scatter step itself, so the result returns to the aggregator. The returned
+// timeout Message expires the scatter, when sent back with the Timeout delay.
+// Scattering the same Message again yields the same Branch ID.
+func (msg Message) Scatter() (branches []Message, timeout Message, err error) {
+	step, err := msg.CurrentStep()
+	if err != nil {
+		return nil, timeout, err
+	}
+	if step.Scatter == nil {
+		return nil, timeout, fmt.Errorf("step %d / %d does not scatter",
+			msg.Routing.Position+1, len(msg.Routing.Slip))
+	}
+
+	id := fmt.Sprintf("%s/%d", msg.TraceID, msg.Routing.Position)
+
+	for i, branch := range step.Scatter.Branches {
+		next := Message{
+			Routing: Routing{
+				Name: msg.Routing.Name,
+				Slip: []Step{branch, {Queue: step.Queue}},
+			},
+			TraceID:   msg.TraceID,
+			MetaData:  msg.MetaData,
+			Documents: msg.Documents,
+			Branch:    &Branch{ID: id, Index: i},
+		}.Begin()
+		branches = append(branches, *next)
+	}
+
+	timeout = msg
+	timeout.Branch = &Branch{ID: id, Timeout: true}
+
+	return branches, timeout, nil
+}
+
+// Join merges the results of the branches into the MetaData and Documents, in
+// order of the branches, and advances the Message past the scatter step. The
+// results are indexed by branch, with nil for missing branches.
+func (msg Message) Join(results []*Message) (*Message, error) {
+	docs := Documents{}
+	md := MetaData{}
+	var missing []int
+
+	for i, result := range results {
+		if result == nil {
+			missing = append(missing, i)
+			continue
+		}
+		for k, v := range result.Documents {
+			docs[k] = v
+		}
+		for k, v := range result.MetaData {
+			md[k] = v
+		}
+	}
+	if len(missing) > 0 {
+		md[GatherMissing] = missing
+	}
+
+	msg.Branch = nil
+	return msg.Advance(&docs, &md)
+}
@@ -0,0 +1,127 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"reflect"
+	"testing"
+)
+
+func TestScatter(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-scatter",
+			Slip: []payload.Step{
+				{Queue: "aggregator", Scatter: &payload.Scatter{
+					Branches: []payload.Step{
+						{Queue: "left"},
+						{Queue: "right", When: &payload.Condition{MetaData: "missing"}},
+					},
+				}},
+				{Queue: "next"},
+			},
+		},
+		payload.MetaData{"meta": "data"},
+		payload.Documents{},
+	)
+
+	branches, timeout, err := msg.Scatter()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("Unexpected number of branches. Have %d, want %d.", len(branches), 2)
+	}
+
+	for i, branch := range branches {
+		if branch.TraceID != msg.TraceID {
+			t.Errorf("TraceID changed. Have %q, want %q.", branch.TraceID, msg.TraceID)
+		}
+		if branch.Branch == nil || branch.Branch.Index != i || branch.Branch.ID != timeout.Branch.ID {
+			t.Errorf("Unexpected branch %d: %+v", i, branch.Branch)
+		}
+		if last := branch.Routing.Slip[len(branch.Routing.Slip)-1]; last.Queue != "aggregator" {
+			t.Errorf("Branch %d should return to the aggregator: %+v", i, branch.Routing.Slip)
+		}
+	}
+
+	if step, _ := branches[0].CurrentStep(); step.Queue != "left" {
+		t.Errorf("Unexpected branch queue. Have %q, want %q.", step.Queue, "left")
+	}
+	if step, _ := branches[1].CurrentStep(); step.Queue != "aggregator" {
+		t.Errorf("Skipped branch should return immediately, not to %q.", step.Queue)
+	}
+
+	if !timeout.Branch.Timeout || timeout.Routing.Position != 0 {
+		t.Errorf("Unexpected timeout message: %+v", timeout)
+	}
+	if msg.Branch != nil {
+		t.Errorf("Original message modified: %+v", msg.Branch)
+	}
+
+	_, again, err := msg.Scatter()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if again.Branch.ID != timeout.Branch.ID {
+		t.Errorf("Unexpected scatter id. Have %q, want %q.",
+			again.Branch.ID, timeout.Branch.ID)
+	}
+
+	msg.Routing.Position = 1
+	if _, _, err = msg.Scatter(); err == nil {
+		t.Errorf("Expected error for step without scatter, got nil")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-join",
+			Slip: []payload.Step{
+				{Queue: "aggregator"},
+				{Queue: "next"},
+			},
+		},
+		payload.MetaData{"meta": "data"},
+		payload.Documents{
+			"input": payload.NewDocument("test", "text/plain", ""),
+		},
+	)
+
+	results := []*payload.Message{
+		{
+			MetaData:  payload.MetaData{"meta": "data", "first": "one"},
+			Documents: payload.Documents{"out": payload.NewDocument("first", "text/plain", "")},
+		},
+		nil,
+		{
+			MetaData:  payload.MetaData{"first": "three"},
+			Documents: payload.Documents{"out": payload.NewDocument("third", "text/plain", "")},
+		},
+	}
+
+	next, err := msg.Join(results)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if next == nil {
+		t.Fatalf("Expected next message, got nil")
+	}
+
+	if next.Routing.Position != 1 {
+		t.Errorf("Expected position advance. Have %d, want %d.", next.Routing.Position, 1)
+	}
+	if d := next.Documents["out"]; d.Data != "third" {
+		t.Errorf("Unexpected 'out' content. Want %q, have %q", "third", d.Data)
+	}
+	if _, ok := next.Documents["input"]; !ok {
+		t.Errorf("Next should contain 'input' document")
+	}
+	if next.MetaData["first"] != "three" || next.MetaData["meta"] != "data" {
+		t.Errorf("Unexpected metadata: %+v", next.MetaData)
+	}
+	if missing := next.MetaData[payload.GatherMissing]; !reflect.DeepEqual(missing, []int{1}) {
+		t.Errorf("Unexpected missing branches. Have %+v, want %+v.", missing, []int{1})
+	}
+}
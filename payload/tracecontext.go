@@ -0,0 +1,53 @@
+package payload
+
+import (
+	"sort"
+)
+
+// TraceContext is the MetaData key holding the propagated tracing context of a
+// Message, e.g. the W3C traceparent, so every step continues the same trace.
+const TraceContext = "trace_context"
+
+// TraceCarrier exposes the TraceContext of MetaData as a text map, e.g. for an
+// OpenTelemetry propagator.
+type TraceCarrier MetaData
+
+// Get returns the value of the key in the TraceContext, if any.
+func (c TraceCarrier) Get(key string) string {
+	switch tc := c[TraceContext].(type) {
+	case map[string]interface{}:
+		v, _ := tc[key].(string)
+		return v
+	case map[string]string:
+		return tc[key]
+	}
+	return ""
+}
+
+// Set stores the value of the key in the TraceContext. The TraceContext is
+// replaced rather than updated, as it may be shared with other messages.
+func (c TraceCarrier) Set(key, value string) {
+	tc := map[string]interface{}{}
+	for _, k := range c.Keys() {
+		tc[k] = c.Get(k)
+	}
+	tc[key] = value
+	c[TraceContext] = tc
+}
+
+// Keys lists the keys in the TraceContext.
+func (c TraceCarrier) Keys() []string {
+	var keys []string
+	switch tc := c[TraceContext].(type) {
+	case map[string]interface{}:
+		for k := range tc {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range tc {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,43 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTraceCarrier(t *testing.T) {
+	shared := map[string]interface{}{"tracestate": "a=b"}
+	md := payload.MetaData{payload.TraceContext: shared}
+	c := payload.TraceCarrier(md)
+
+	c.Set("traceparent", "00-trace-span-01")
+
+	if have := strings.Join(c.Keys(), ","); have != "traceparent,tracestate" {
+		t.Errorf("Unexpected keys. Have %q, want %q.", have, "traceparent,tracestate")
+	}
+	if _, ok := shared["traceparent"]; ok {
+		t.Errorf("Unexpected update of the shared TraceContext: %+v", shared)
+	}
+
+	body, err := json.Marshal(md)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	var parsed payload.MetaData
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	for key, want := range map[string]string{
+		"traceparent": "00-trace-span-01",
+		"tracestate":  "a=b",
+		"missing":     "",
+	} {
+		if have := payload.TraceCarrier(parsed).Get(key); have != want {
+			t.Errorf("Unexpected value for %q. Have %q, want %q.", key, have, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package payload
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ValidationError lists all problems found in a route definition.
+type ValidationError struct {
+	Route    string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid route %q: %s",
+		e.Route, strings.Join(e.Problems, "; "))
+}
+
+// Validate checks the route definition for mistakes which would otherwise only
+// surface once a message is underway, such as steps without a queue, or
+// rewinds past the start of the slip. Returns a *ValidationError listing all
+// problems, or nil if the route is valid.
+func (r Routing) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if r.Name == "" {
+		report("empty route name")
+	}
+	if len(r.Slip) == 0 {
+		report("empty slip")
+	}
+	if r.Position < 0 || (len(r.Slip) > 0 && r.Position >= len(r.Slip)) {
+		report("position %d outside of slip", r.Position)
+	}
+
+	for i, step := range r.Slip {
+		switch {
+		case step.Route != "" && step.Queue != "":
+			report("step %d: both queue and route", i)
+		case step.Route != "" && step.Scatter != nil:
+			report("step %d: scatter on route", i)
+		case step.Route == "" && strings.TrimSpace(step.Queue) == "":
+			report("step %d: empty queue name", i)
+		}
+		if step.Route != "" && (step.ErrorHandling != ErrorHandling{} || step.Timeout != 0 || step.Compensate != "") {
+			report("step %d: on_error, timeout, or compensate on route", i)
+		}
+		if step.MaxRetries < 0 {
+			report("step %d: negative max_retries %d", i, step.MaxRetries)
+		}
+		if step.Timeout < 0 {
+			report("step %d: negative timeout %s", i, time.Duration(step.Timeout))
+		}
+
+		for _, problem := range step.When.Validate() {
+			report("step %d: when: %s", i, problem)
+		}
+		for _, problem := range step.Backoff.validate() {
+			report("step %d: backoff: %s", i, problem)
+		}
+
+		if step.Scatter != nil {
+			for _, problem := range step.Scatter.validate() {
+				report("step %d: scatter: %s", i, problem)
+			}
+		}
+
+		switch {
+		case step.Rewind < 0:
+			report("step %d: negative rewind %d", i, step.Rewind)
+		case i-step.Rewind < 0:
+			report("step %d: rewind %d past the start of the slip", i, step.Rewind)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Route: r.Name, Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package payload_test
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRoutingValidate(t *testing.T) {
+	type testCase struct {
+		route    payload.Routing
+		problems []string
+	}
+
+	for name, tc := range map[string]testCase{
+		"valid": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "foo"},
+					{Queue: "bar", ErrorHandling: payload.ErrorHandling{Rewind: 1}},
+				},
+			},
+		},
+		"empty": {
+			route:    payload.Routing{},
+			problems: []string{"empty route name", "empty slip"},
+		},
+		"empty queue": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{{Queue: "foo"}, {Queue: " "}},
+			},
+			problems: []string{"step 1: empty queue name"},
+		},
+		"sub-route": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Route: "other"},
+					{Route: "other", Queue: "foo"},
+					{Route: "other", ErrorHandling: payload.ErrorHandling{MaxRetries: 1}},
+				},
+			},
+			problems: []string{
+				"step 1: both queue and route",
+				"step 2: on_error, timeout, or compensate on route",
+			},
+		},
+		"negative rewind": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "foo", ErrorHandling: payload.ErrorHandling{Rewind: -1}},
+				},
+			},
+			problems: []string{"step 0: negative rewind -1"},
+		},
+		"rewind past start": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "foo"},
+					{Queue: "bar", ErrorHandling: payload.ErrorHandling{Rewind: 2}},
+				},
+			},
+			problems: []string{"step 1: rewind 2 past the start of the slip"},
+		},
+		"bad condition": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "foo", When: &payload.Condition{MetaData: "a", Op: "like"}},
+				},
+			},
+			problems: []string{`step 0: when: unknown op "like"`},
+		},
+		"bad scatter": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "aggregator", Scatter: &payload.Scatter{
+						Branches: []payload.Step{
+							{Queue: ""},
+							{Queue: "foo", Scatter: &payload.Scatter{}},
+						},
+						Quorum: 3,
+					}},
+				},
+			},
+			problems: []string{
+				"step 0: scatter: quorum 3 outside of branches",
+				"step 0: scatter: branch 0: empty queue name",
+				"step 0: scatter: branch 1: nested scatter",
+			},
+		},
+		"bad backoff": {
+			route: payload.Routing{
+				Name: "demo",
+				Slip: []payload.Step{
+					{Queue: "foo", ErrorHandling: payload.ErrorHandling{
+						Backoff: &payload.Backoff{Multiplier: 0.5, Jitter: 1.5},
+					}},
+					{Queue: "aggregator", Scatter: &payload.Scatter{
+						Branches: []payload.Step{
+							{Queue: "bar", ErrorHandling: payload.ErrorHandling{
+								Backoff: &payload.Backoff{Jitter: -0.1},
+							}},
+						},
+					}},
+				},
+			},
+			problems: []string{
+				"step 0: backoff: multiplier 0.5 below 1",
+				"step 0: backoff: jitter 1.5 outside of 0 to 1",
+				"step 1: scatter: branch 0: backoff: jitter -0.1 outside of 0 to 1",
+			},
+		},
+		"bad position": {
+			route: payload.Routing{
+				Name:     "demo",
+				Position: 1,
+				Slip:     []payload.Step{{Queue: "foo"}},
+			},
+			problems: []string{"position 1 outside of slip"},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := tc.route.Validate()
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Errorf("Unexpected error: %+v", err)
+				}
+				return
+			}
+
+			var verr *payload.ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected ValidationError, got %+v", err)
+			}
+			if strings.Join(verr.Problems, "|") != strings.Join(tc.problems, "|") {
+				t.Errorf("Unexpected problems. Have %q, want %q.",
+					verr.Problems, tc.problems)
+			}
+		})
+	}
+}
+
+func TestParseRoutesInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown field": `
+- name: demo
+  slip:
+    - queue: foo
+      on_error:
+        max_retry: 3
+`,
+		"empty queue": `
+- name: demo
+  slip:
+    - queue: ""
+`,
+		"rewind past start": `
+- name: demo
+  slip:
+    - queue: foo
+      on_error:
+        rewind: 1
+`,
+	} {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			if _, err := payload.ParseRoutes([]byte(data)); err == nil {
+				t.Errorf("Expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package gonyexpress
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"fmt"
+	"time"
+)
+
+// PingHop is the outcome of a ping for a single step of the slip.
+type PingHop struct {
+	Position int
+	Queue    string
+	// Time at which the ping passed the step. Zero if it was not reached.
+	Time time.Time
+	// Latency since the ping passed the previous step, or was sent.
+	Latency time.Duration
+}
+
+// PingResult lists the outcome of a ping for every step of the slip.
+type PingResult struct {
+	Sent time.Time
+	Hops []PingHop
+}
+
+// Dead returns the first step the ping did not pass, if any.
+func (r PingResult) Dead() (PingHop, bool) {
+	for _, hop := range r.Hops {
+		if hop.Time.IsZero() {
+			return hop, true
+		}
+	}
+	return PingHop{}, false
+}
+
+// Slow returns the steps the ping took longer than the threshold to pass.
+func (r PingResult) Slow(threshold time.Duration) []PingHop {
+	var slow []PingHop
+	for _, hop := range r.Hops {
+		if hop.Latency > threshold {
+			slow = append(slow, hop)
+		}
+	}
+	return slow
+}
+
+// Ping sends a ping message along every queue of the routing slip, including
+// the branches of scatter steps, without processing it. Conditions are ignored,
+// and sub-routes must be expanded, e.g. by Routes.Route. The result holds the
+// time at which every step was passed. If the context expires first, the error
+// is returned with the steps passed so far, as reported by progress events.
+// The Producer must be created for the AMQPReplyTo queue, and be connected.
+func (c *Component) Ping(ctx context.Context, routing pl.Routing) (PingResult, error) {
+	var slip []pl.Step
+	for i, step := range routing.Slip {
+		if step.Route != "" {
+			return PingResult{}, fmt.Errorf("step %d: unexpanded sub-route %q", i, step.Route)
+		}
+		slip = append(slip, pl.Step{Queue: step.Queue})
+		if step.Scatter != nil {
+			for _, branch := range step.Scatter.Branches {
+				slip = append(slip, pl.Step{Queue: branch.Queue})
+			}
+		}
+	}
+
+	msg := pl.NewMessage(
+		pl.Routing{Name: routing.Name, Slip: slip},
+		pl.MetaData{
+			pl.Ping:          true,
+			pl.ProgressQueue: broker.AMQPReplyTo,
+		},
+		pl.Documents{},
+	)
+
+	result := PingResult{Hops: make([]PingHop, len(slip))}
+	for i, step := range slip {
+		result.Hops[i] = PingHop{Position: i, Queue: step.Queue}
+	}
+
+	watch, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := c.Progress(watch, msg.TraceID)
+	if err != nil {
+		return result, err
+	}
+
+	// Progress events tell how far the ping got, should it never reply
+	reached := map[int]time.Time{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			reached[event.Position] = time.Now().UTC()
+		}
+	}()
+
+	result.Sent = time.Now().UTC()
+	reply, err := c.Call(ctx, msg)
+	cancel()
+	<-done
+
+	if err == nil {
+		reached = map[int]time.Time{}
+		for _, hop := range reply.Hops() {
+			reached[hop.Position] = hop.Time
+		}
+	}
+
+	previous := result.Sent
+	for i := range result.Hops {
+		t, ok := reached[i]
+		if !ok {
+			continue
+		}
+		result.Hops[i].Time = t
+		result.Hops[i].Latency = t.Sub(previous)
+		previous = t
+	}
+
+	return result, err
+}
@@ -0,0 +1,144 @@
+package gonyexpress_test
+
+import (
+	"context"
+	"time"
+
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"encoding/json"
+	"testing"
+)
+
+var pingRouting = payload.Routing{
+	Name: "test-ping",
+	Slip: []payload.Step{
+		{Queue: "foo", When: &payload.Condition{MetaData: "never"}},
+		{Queue: "aggregator", Scatter: &payload.Scatter{
+			Branches: []payload.Step{{Queue: "left"}, {Queue: "right"}},
+		}},
+	},
+}
+
+// pong plays the Component at the current step of the ping message, and
+// returns the next message. The progress event is delivered to the Producer.
+func pong(t *testing.T, m *broker.MockBroker, msg *payload.Message) *payload.Message {
+	t.Helper()
+
+	next, err := msg.Advance(nil, msg.Hop(time.Now()))
+	if err != nil || next == nil {
+		t.Fatalf("Failed to advance ping: %+v, %+v", next, err)
+	}
+
+	body, _ := json.Marshal(msg.Progress(payload.ProgressDone, 0, nil))
+	m.Publish(broker.MockReplyTo, body, map[string]interface{}{
+		"x-gonyexpress-progress": true,
+	})
+	m.Deliver(m.TakeDelivery(1 * time.Second))
+
+	return next
+}
+
+func TestProducerPing(t *testing.T) {
+	p := ge.NewProducer("mock://", broker.AMQPReplyTo)
+	m := p.Broker.(*broker.MockBroker)
+
+	if _, err := p.Connect(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer p.Close()
+
+	type outcome struct {
+		result ge.PingResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		result, err := p.Ping(ctx, pingRouting)
+		done <- outcome{result, err}
+	}()
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a ping message, got nil")
+	}
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	broker.ResolveReplyTo(msg, d.ReplyTo())
+
+	queues := []string{"foo", "aggregator", "left", "right"}
+	for _, queue := range queues {
+		if step, _ := msg.CurrentStep(); step.Queue != queue {
+			t.Errorf("Unexpected ping step. Have %q, want %q.", step.Queue, queue)
+		}
+		msg = pong(t, m, msg)
+	}
+	if _, err = m.DeliverMessage(*msg); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	o := <-done
+	if o.err != nil {
+		t.Fatalf("Unexpected error: %+v", o.err)
+	}
+	if hop, dead := o.result.Dead(); dead {
+		t.Errorf("Unexpected dead step: %+v", hop)
+	}
+	if len(o.result.Hops) != len(queues) {
+		t.Fatalf("Unexpected hops. Have %d, want %d.", len(o.result.Hops), len(queues))
+	}
+	for i, hop := range o.result.Hops {
+		if hop.Queue != queues[i] || hop.Time.Before(o.result.Sent) {
+			t.Errorf("Unexpected hop %d: %+v", i, hop)
+		}
+	}
+	if slow := o.result.Slow(time.Second); len(slow) != 0 {
+		t.Errorf("Unexpected slow steps: %+v", slow)
+	}
+}
+
+func TestProducerPingDead(t *testing.T) {
+	p := ge.NewProducer("mock://", broker.AMQPReplyTo)
+	m := p.Broker.(*broker.MockBroker)
+
+	if _, err := p.Connect(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer p.Close()
+
+	type outcome struct {
+		result ge.PingResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		result, err := p.Ping(ctx, pingRouting)
+		done <- outcome{result, err}
+	}()
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a ping message, got %+v, %+v", msg, err)
+	}
+	pong(t, m, msg)
+
+	o := <-done
+	if o.err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error. Have %+v, want %+v.", o.err, context.DeadlineExceeded)
+	}
+	hop, dead := o.result.Dead()
+	if !dead || hop.Queue != "aggregator" {
+		t.Errorf("Unexpected dead step: %+v", hop)
+	}
+	if o.result.Hops[0].Time.IsZero() {
+		t.Errorf("Expected first step to be reached: %+v", o.result.Hops[0])
+	}
+}
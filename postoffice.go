@@ -0,0 +1,58 @@
+package gonyexpress
+
+import (
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"sync"
+)
+
+// NewPostOffice creates a post-office Component instance ready to connect to
+// the rabbitmq + queue, typically payload.PostOffice. It replaces the routing
+// slip of every received message with the slip of the route by the same name,
+// and forwards it to the first step whose condition holds. Steps following the
+// post-office step, e.g. a reply step, are appended to the slip of the route.
+// Messages for unknown routes are sent to the DeadLetter queue.
+func NewPostOffice(URI, qname string, workers int, routes pl.Routes) Component {
+	return Component{
+		Broker:  broker.New(URI, qname),
+		queue:   qname,
+		handle:  postOffice(routes),
+		workers: workers,
+		wg:      sync.WaitGroup{},
+	}
+}
+
+// postOffice returns a handler resolving messages by their route name.
+func postOffice(routes pl.Routes) func(*Component, broker.Delivery, *pl.Message, *pl.Step) {
+	return func(c *Component, d broker.Delivery, msg *pl.Message, _ *pl.Step) {
+		routing, err := routes.Route(msg.Routing.Name)
+		if err != nil {
+			c.logMessage(msg).Errorf("Failed to resolve route: %+v", err)
+			c.deadLetter(d, msg, err)
+			return
+		}
+
+		routing.Slip = append(routing.Slip, msg.Routing.Slip[msg.Routing.Position+1:]...)
+
+		next := pl.Message{
+			Routing:   routing,
+			TraceID:   msg.TraceID,
+			MetaData:  msg.MetaData,
+			Documents: msg.Documents,
+		}.Begin()
+		if next == nil {
+			c.logMessage(msg).Infof("No step applies for %q", msg.Routing.Name)
+			d.Ack()
+			return
+		}
+
+		if err = c.SendMessage(*next); err != nil {
+			c.failedSend(d, next, err)
+			return
+		}
+
+		c.logMessage(msg).Infof("Routed message for %q", msg.Routing.Name)
+		d.Ack()
+	}
+}
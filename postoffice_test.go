@@ -0,0 +1,170 @@
+package gonyexpress_test
+
+import (
+	"time"
+
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"testing"
+)
+
+var testRoutes = payload.Routes{
+	"demo": payload.Routing{
+		Name: "demo",
+		Slip: []payload.Step{
+			{Queue: "foo"},
+			{Queue: "bar"},
+		},
+	},
+	"conditional": payload.Routing{
+		Name: "conditional",
+		Slip: []payload.Step{
+			{Queue: "ocr", When: &payload.Condition{ContentType: "image/*"}},
+			{Queue: "bar"},
+		},
+	},
+}
+
+func TestPostOffice(t *testing.T) {
+	c := ge.NewPostOffice("mock://", payload.PostOffice, 1, testRoutes)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessageForRoute(
+		"demo",
+		payload.MetaData{"meta": "data"},
+		payload.Documents{
+			"input": payload.NewDocument("Hello", "text/plain", ""),
+		},
+	)
+
+	delivery, err := m.DeliverMessage(orig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a routed message, got nil")
+	}
+	if d.Queue != "foo" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "foo")
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if msg.TraceID != orig.TraceID {
+		t.Errorf("TraceID changed. Have %q, want %q.", msg.TraceID, orig.TraceID)
+	}
+	if msg.Routing.Position != 0 || len(msg.Routing.Slip) != 2 {
+		t.Errorf("Unexpected routing: %+v", msg.Routing)
+	}
+	if _, ok := msg.Documents["input"]; !ok {
+		t.Errorf("Routed message should contain 'input' document")
+	}
+	if msg.MetaData["meta"] != "data" {
+		t.Errorf("Unexpected 'meta' metadata in %+v", msg.MetaData)
+	}
+
+	if s, _ := delivery.Settlement(1 * time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+}
+
+func TestPostOfficeUnknownRoute(t *testing.T) {
+	c := ge.NewPostOffice("mock://", payload.PostOffice, 1, testRoutes)
+	c.DeadLetter = "dead-letters"
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessageForRoute("unknown", payload.MetaData{}, payload.Documents{})
+
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a dead-lettered message, got nil")
+	}
+	if d.Queue != "dead-letters" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "dead-letters")
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if msg.Routing.Name != "unknown" {
+		t.Errorf("Unexpected route. Have %q, want %q.", msg.Routing.Name, "unknown")
+	}
+}
+
+func TestPostOfficeConditional(t *testing.T) {
+	c := ge.NewPostOffice("mock://", payload.PostOffice, 1, testRoutes)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessageForRoute(
+		"conditional",
+		payload.MetaData{},
+		payload.Documents{
+			"input": payload.NewDocument("Hello", "text/plain", ""),
+		},
+	)
+
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a routed message, got nil")
+	}
+	if d.Queue != "bar" {
+		t.Errorf("Unexpected queue. Have %q, want %q.", d.Queue, "bar")
+	}
+}
+
+func TestPostOfficeReplyTo(t *testing.T) {
+	c := ge.NewPostOffice("mock://", payload.PostOffice, 1, testRoutes)
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	orig := payload.NewMessageForRoute("demo", payload.MetaData{}, payload.Documents{})
+	orig.Routing.Slip = append(orig.Routing.Slip, payload.Step{Queue: broker.AMQPReplyTo})
+
+	if _, err := m.DeliverMessage(orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	msg, err := m.TakeMessage(1 * time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("Expected a routed message, got %+v, %+v", msg, err)
+	}
+
+	slip := msg.Routing.Slip
+	if len(slip) != 3 || slip[2].Queue != broker.MockReplyTo {
+		t.Errorf("Expected reply step after the route: %+v", slip)
+	}
+}
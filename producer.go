@@ -2,6 +2,13 @@ package gonyexpress
 
 import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/logger"
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 )
 
 // NewProducer creates a Component instance ready to Connect to the rabbitmq,
@@ -10,8 +17,191 @@ import (
 // result or progress updates, otherwise it is recommended to set the queue to:
 // 'amq.rabbitmq.reply-to' (AMQPReplyTo) for a Direct Reply-To.
 func NewProducer(URI, qname string) Component {
+	var r *replies
+	if qname == broker.AMQPReplyTo {
+		r = &replies{
+			pending:  map[string]chan *pl.Message{},
+			watchers: map[string]chan pl.Progress{},
+		}
+	}
+
 	return Component{
 		Broker:  broker.New(URI, qname),
+		queue:   qname,
+		replies: r,
 		workers: 0,
 	}
 }
+
+// ErrNoReplyTo is returned by Call for a Producer not consuming AMQPReplyTo.
+var ErrNoReplyTo = fmt.Errorf("call requires a producer for %q", broker.AMQPReplyTo)
+
+// Call sends the message with an AMQPReplyTo step appended to the slip, and
+// waits for the message to arrive at that step, or for the context to expire.
+// Many calls can wait at the same time, as replies are matched by TraceID. The
+// Producer must be created for the AMQPReplyTo queue, and be connected.
+func (c *Component) Call(ctx context.Context, msg pl.Message) (*pl.Message, error) {
+	if c.replies == nil {
+		return nil, ErrNoReplyTo
+	}
+
+	slip := make([]pl.Step, len(msg.Routing.Slip), len(msg.Routing.Slip)+1)
+	copy(slip, msg.Routing.Slip)
+	msg.Routing.Slip = append(slip, pl.Step{Queue: broker.AMQPReplyTo})
+
+	reply := c.replies.expect(msg.TraceID)
+	defer c.replies.forget(msg.TraceID)
+
+	if err := c.SendMessageContext(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// replyBuffer is the number of deliveries, other than replies to a Call, kept
+// for the channel returned by Connect.
+const replyBuffer = 16
+
+// Progress returns a channel receiving the Progress events of the messages with
+// the TraceID, which is closed once the context is done. Set the ProgressQueue
+// of the messages to AMQPReplyTo, to have the events sent to the Producer. The
+// Producer must be created for the AMQPReplyTo queue, and be connected. Events
+// are dropped if the channel is not read.
+func (c *Component) Progress(ctx context.Context, traceID string) (<-chan pl.Progress, error) {
+	if c.replies == nil {
+		return nil, ErrNoReplyTo
+	}
+
+	events := c.replies.watch(traceID)
+	go func() {
+		<-ctx.Done()
+		c.replies.unwatch(traceID, events)
+	}()
+
+	return events, nil
+}
+
+// progressBuffer is the number of Progress events kept per TraceID.
+const progressBuffer = 16
+
+// replies tracks the calls awaiting a reply, and the Progress channels, by
+// TraceID.
+type replies struct {
+	mu       sync.Mutex
+	pending  map[string]chan *pl.Message
+	watchers map[string]chan pl.Progress
+}
+
+func (r *replies) expect(traceID string) <-chan *pl.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := make(chan *pl.Message, 1)
+	r.pending[traceID] = reply
+	return reply
+}
+
+func (r *replies) forget(traceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, traceID)
+}
+
+func (r *replies) watch(traceID string) chan pl.Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if events, ok := r.watchers[traceID]; ok {
+		close(events)
+	}
+	events := make(chan pl.Progress, progressBuffer)
+	r.watchers[traceID] = events
+	return events
+}
+
+func (r *replies) unwatch(traceID string, events chan pl.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.watchers[traceID] == events {
+		delete(r.watchers, traceID)
+		close(events)
+	}
+}
+
+// dispatch passes the replies to the waiting calls, and Progress events to the
+// watching channels. Other deliveries are passed on through the returned
+// channel, but dropped if it is not read. Replies are received in auto ack
+// mode, so deliveries are not settled.
+func (r *replies) dispatch(msgs <-chan broker.Delivery, log logger.Logger) <-chan broker.Delivery {
+	other := make(chan broker.Delivery, replyBuffer)
+
+	go func() {
+		defer close(other)
+
+		for d := range msgs {
+			if _, ok := d.Headers()[progressHeader]; ok {
+				r.progress(d, log)
+				continue
+			}
+
+			msg, err := pl.MessageFromByteSlice(d.Body())
+			if err == nil && r.reply(msg) {
+				continue
+			}
+
+			select {
+			case other <- d:
+			default:
+				log.WithFields(logger.Fields{logger.TraceID: d.CorrelationID()}).
+					Warnf("Dropping unexpected reply")
+			}
+		}
+	}()
+
+	return other
+}
+
+// reply passes the message to the call waiting for it, if any.
+func (r *replies) reply(msg *pl.Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply, ok := r.pending[msg.TraceID]
+	if ok {
+		delete(r.pending, msg.TraceID)
+		reply <- msg
+	}
+	return ok
+}
+
+// progress passes the Progress event to the channel watching its TraceID, if
+// any.
+func (r *replies) progress(d broker.Delivery, log logger.Logger) {
+	var event pl.Progress
+	if err := json.Unmarshal(d.Body(), &event); err != nil {
+		log.WithFields(logger.Fields{logger.TraceID: d.CorrelationID()}).
+			Warnf("Bad progress event: %+v", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events, ok := r.watchers[event.TraceID]
+	if !ok {
+		return
+	}
+	select {
+	case events <- event:
+	default:
+		log.WithFields(logger.Fields{logger.TraceID: event.TraceID}).
+			Warnf("Dropping progress event")
+	}
+}
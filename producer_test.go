@@ -7,6 +7,8 @@ import (
 	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
 	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
 
+	"context"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -63,3 +65,180 @@ func TestProducer(t *testing.T) {
 		t.Errorf("Unexpected 'input' content. Want %q, have %q", "Hello", d.Data)
 	}
 }
+
+// replyTo plays the consumers along the slip of the sent message, returning the
+// final message to the Producer, as if by Direct Reply-To.
+func replyTo(t *testing.T, m *broker.MockBroker) {
+	t.Helper()
+
+	d := m.TakeDelivery(1 * time.Second)
+	if d == nil {
+		t.Fatalf("Expected a message, got nil")
+	}
+	if d.ReplyTo() != broker.MockReplyTo {
+		t.Errorf("Unexpected reply-to. Have %q, want %q.", d.ReplyTo(), broker.MockReplyTo)
+	}
+
+	msg, err := payload.MessageFromByteSlice(d.Body())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	broker.ResolveReplyTo(msg, d.ReplyTo())
+
+	next, err := msg.Advance(&payload.Documents{
+		"output": payload.NewDocument(msg.TraceID, "text/plain", ""),
+	}, nil)
+	if err != nil || next == nil {
+		t.Fatalf("Failed to advance: %+v, %+v", next, err)
+	}
+	if step, _ := next.CurrentStep(); step.Queue != broker.MockReplyTo {
+		t.Errorf("Unexpected reply queue. Have %q, want %q.", step.Queue, broker.MockReplyTo)
+	}
+
+	if _, err = m.DeliverMessage(*next); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+}
+
+func TestProducerCall(t *testing.T) {
+	p := ge.NewProducer("mock://", broker.AMQPReplyTo)
+	m := p.Broker.(*broker.MockBroker)
+
+	if _, err := p.Connect(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer p.Close()
+
+	const calls = 3
+	type result struct {
+		orig  payload.Message
+		reply *payload.Message
+		err   error
+	}
+	results := make(chan result, calls)
+
+	for i := 0; i < calls; i++ {
+		go func() {
+			orig := payload.NewMessage(
+				payload.Routing{
+					Name: "test-call",
+					Slip: []payload.Step{{Queue: "foo"}},
+				},
+				payload.MetaData{},
+				payload.Documents{},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			reply, err := p.Call(ctx, orig)
+			results <- result{orig, reply, err}
+		}()
+	}
+
+	for i := 0; i < calls; i++ {
+		replyTo(t, m)
+	}
+
+	for i := 0; i < calls; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("Unexpected error: %+v", r.err)
+			continue
+		}
+		if r.reply.TraceID != r.orig.TraceID {
+			t.Errorf("TraceID changed. Have %q, want %q.", r.reply.TraceID, r.orig.TraceID)
+		}
+		if d := r.reply.Documents["output"]; d.Data != r.orig.TraceID {
+			t.Errorf("Reply for another call. Have %q, want %q.", d.Data, r.orig.TraceID)
+		}
+	}
+}
+
+func TestProducerCallTimeout(t *testing.T) {
+	p := ge.NewProducer("mock://", broker.AMQPReplyTo)
+
+	if _, err := p.Connect(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer p.Close()
+
+	orig := payload.NewMessageForRoute("test-call", payload.MetaData{}, payload.Documents{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.Call(ctx, orig); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error. Have %+v, want %+v.", err, context.DeadlineExceeded)
+	}
+
+	q := ge.NewProducer("mock://", "")
+	if _, err := q.Call(ctx, orig); err != ge.ErrNoReplyTo {
+		t.Errorf("Unexpected error. Have %+v, want %+v.", err, ge.ErrNoReplyTo)
+	}
+}
+
+func TestProducerProgress(t *testing.T) {
+	p := ge.NewProducer("mock://", broker.AMQPReplyTo)
+	m := p.Broker.(*broker.MockBroker)
+
+	if _, err := p.Connect(); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	defer p.Close()
+
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "test-progress",
+			Slip: []payload.Step{{Queue: "foo"}, {Queue: "bar"}},
+		},
+		payload.MetaData{payload.ProgressQueue: broker.AMQPReplyTo},
+		payload.Documents{},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := p.Progress(ctx, msg.TraceID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	if err = p.SendMessage(msg); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if d := m.TakeDelivery(1 * time.Second); d == nil || d.ReplyTo() != broker.MockReplyTo {
+		t.Fatalf("Expected a message with reply-to, got %+v", d)
+	}
+
+	// Play the consumer of the first step, publishing to the Producer
+	for _, traceID := range []string{"other", msg.TraceID} {
+		event := msg.Progress(payload.ProgressDone, time.Second, nil)
+		event.TraceID = traceID
+		body, _ := json.Marshal(event)
+
+		if err = m.Publish(broker.MockReplyTo, body, map[string]interface{}{
+			"x-gonyexpress-progress": true,
+		}); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		m.Deliver(m.TakeDelivery(1 * time.Second))
+	}
+
+	select {
+	case event := <-events:
+		if event.TraceID != msg.TraceID || event.Queue != "foo" || event.Status != payload.ProgressDone {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Expected a progress event, got none")
+	}
+
+	cancel()
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("Expected events to be closed")
+	}
+}
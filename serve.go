@@ -0,0 +1,64 @@
+package gonyexpress
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultDrainTimeout is the time the operators get to finish the messages in
+// flight when draining a Component without a DrainTimeout.
+const DefaultDrainTimeout = 30 * time.Second
+
+// Serve runs the Component until the context is done, or the process receives
+// a SIGINT or SIGTERM, and then drains it. It blocks until the Component is
+// shut down.
+func (c *Component) Serve(ctx context.Context) error {
+	if err := c.Run(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	<-ctx.Done()
+	c.Drain()
+	return nil
+}
+
+// Drain stops consuming the queue, and gives the operators up to DrainTimeout
+// to finish the messages in flight, including those already received. The
+// Component is then shut down. Operators still running by then are cancelled,
+// but not waited for, and the Broker is closed to requeue their messages.
+func (c *Component) Drain() {
+	if c.shutdown == nil {
+		return
+	}
+
+	timeout := c.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	c.log().Infof("Draining for up to %s", timeout)
+	c.health.shutdown(true)
+	if err := c.Broker.Cancel(); err != nil {
+		c.log().Warnf("Failed to stop consuming: %+v", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		c.stop(true)
+	case <-time.After(timeout):
+		c.log().Warnf("Drain timed out after %s", timeout)
+		c.stop(false)
+	}
+}
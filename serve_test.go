@@ -0,0 +1,225 @@
+package gonyexpress_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"os"
+	"os/signal"
+	"testing"
+	"time"
+)
+
+func serveMessage(route string) payload.Message {
+	return payload.NewMessage(
+		payload.Routing{
+			Name: route,
+			Slip: []payload.Step{{Queue: "test"}, {Queue: "next"}},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+}
+
+func TestServeDrain(t *testing.T) {
+	started := make(chan bool, 2)
+	release := make(chan bool)
+	operator := func(
+		ctx context.Context, _ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		started <- true
+		<-release
+		return nil, nil, nil
+	}
+
+	c := ge.NewContextConsumer("mock://", "test", 1, operator)
+	m := c.Broker.(*broker.MockBroker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- c.Serve(ctx)
+	}()
+
+	first, err := m.DeliverMessage(serveMessage("first"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	// Received, but not yet handled, when draining starts
+	second, err := m.DeliverMessage(serveMessage("second"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("Operator was not called")
+	}
+
+	cancel()
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned before draining: %+v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if c.Health().Ready() {
+		t.Errorf("Expected the Component not to be ready while draining")
+	}
+
+	close(release)
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after draining")
+	}
+
+	for name, d := range map[string]*broker.MockDelivery{
+		"first":  first,
+		"second": second,
+	} {
+		if s, _ := d.Settlement(time.Second); s != broker.Acked {
+			t.Errorf("Unexpected %s settlement. Have %q, want %q.", name, s, broker.Acked)
+		}
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	started := make(chan bool, 1)
+	operator := func(
+		ctx context.Context, _ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		started <- true
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+
+	c := ge.NewContextConsumer("mock://", "test", 1, operator)
+	c.DrainTimeout = 50 * time.Millisecond
+	m := c.Broker.(*broker.MockBroker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- c.Serve(ctx)
+	}()
+
+	delivery, err := m.DeliverMessage(serveMessage("stuck"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	<-started
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after the drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed < c.DrainTimeout {
+		t.Errorf("Unexpected drain time. Have %s, want at least %s.", elapsed, c.DrainTimeout)
+	}
+
+	if s, requeue := delivery.Settlement(time.Second); s != broker.Nacked || !requeue {
+		t.Errorf("Unexpected settlement. Have %q (requeue %v), want %q (requeue true).",
+			s, requeue, broker.Nacked)
+	}
+}
+
+func TestServeSignal(t *testing.T) {
+	// Keeps the test process alive should the signal arrive early
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	operator := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+
+	served := make(chan error)
+	go func() {
+		served <- c.Serve(context.Background())
+	}()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	for deadline := time.After(time.Second); ; {
+		if err := p.Signal(os.Interrupt); err != nil {
+			t.Skipf("Cannot send interrupt: %+v", err)
+		}
+
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("Serve did not return on interrupt")
+		}
+	}
+}
+
+func TestServeDrainTimeoutStuckOperator(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	defer close(release)
+
+	// A plain Operator has no context to abort it
+	operator := func(
+		_ string, _ payload.MetaData, _ payload.Arguments, _ payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		started <- true
+		<-release
+		return nil, nil, nil
+	}
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	c.DrainTimeout = 50 * time.Millisecond
+	m := c.Broker.(*broker.MockBroker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- c.Serve(ctx)
+	}()
+
+	delivery, err := m.DeliverMessage(serveMessage("stuck"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	<-started
+
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after the drain timeout")
+	}
+
+	if c.Broker.Connected() {
+		t.Errorf("Expected the Broker to be closed")
+	}
+	// Left to the closed Broker to requeue
+	if s, _ := delivery.Settlement(10 * time.Millisecond); s != broker.Unsettled {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Unsettled)
+	}
+}
@@ -0,0 +1,85 @@
+package gonyexpress
+
+import (
+	pl "github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry instrumentation library.
+const tracerName = "github.com/SebastiaanPasterkamp/gonyexpress"
+
+// propagator carries the span context from step to step in the TraceContext of
+// the MetaData, as a W3C traceparent.
+var propagator = propagation.TraceContext{}
+
+// tracer returns the Tracer of the Component, from the global TracerProvider
+// unless the Component has one set.
+func (c *Component) tracer() trace.Tracer {
+	tp := c.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSend starts the root span for a message without a trace yet. The
+// message is returned with the span context in a copy of its MetaData.
+func (c *Component) startSend(ctx context.Context, msg pl.Message) (pl.Message, trace.Span) {
+	ctx, span := c.tracer().Start(ctx, fmt.Sprintf("%s send", msg.Routing.Name),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("gonyexpress.trace_id", msg.TraceID),
+			attribute.String("gonyexpress.route", msg.Routing.Name),
+		),
+	)
+
+	md := pl.MetaData{}
+	for k, v := range msg.MetaData {
+		md[k] = v
+	}
+	propagator.Inject(ctx, pl.TraceCarrier(md))
+	msg.MetaData = md
+
+	return msg, span
+}
+
+// startStep starts the span for the current step of the message, as child of
+// the span context propagated in the MetaData. The span context of the step is
+// stored in the MetaData in turn, to be passed on to the next message.
+func (c *Component) startStep(ctx context.Context, msg *pl.Message, step *pl.Step) (context.Context, trace.Span) {
+	ctx = propagator.Extract(ctx, pl.TraceCarrier(msg.MetaData))
+	ctx, span := c.tracer().Start(ctx, fmt.Sprintf("%s %s", msg.Routing.Name, step.Queue),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("gonyexpress.trace_id", msg.TraceID),
+			attribute.String("gonyexpress.route", msg.Routing.Name),
+			attribute.Int("gonyexpress.position", msg.Routing.Position),
+			attribute.String("gonyexpress.queue", step.Queue),
+			attribute.Int("gonyexpress.attempt", step.Attempt),
+		),
+	)
+
+	if msg.MetaData == nil {
+		msg.MetaData = pl.MetaData{}
+	}
+	propagator.Inject(ctx, pl.TraceCarrier(msg.MetaData))
+
+	return ctx, span
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,117 @@
+package gonyexpress_test
+
+import (
+	ge "github.com/SebastiaanPasterkamp/gonyexpress"
+	"github.com/SebastiaanPasterkamp/gonyexpress/broker"
+	"github.com/SebastiaanPasterkamp/gonyexpress/payload"
+
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	operator := func(
+		traceID string, md payload.MetaData, args payload.Arguments, docs payload.Documents,
+	) (*payload.Documents, *payload.MetaData, error) {
+		if _, ok := args["fail"]; ok {
+			return nil, nil, fmt.Errorf("Please fail this message")
+		}
+		return nil, nil, nil
+	}
+
+	p := ge.NewProducer("mock://", "producer")
+	p.TracerProvider = tp
+	pm := p.Broker.(*broker.MockBroker)
+
+	c := ge.NewConsumer("mock://", "test", 1, operator)
+	c.TracerProvider = tp
+	m := c.Broker.(*broker.MockBroker)
+
+	if err := c.Run(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer c.Shutdown()
+
+	msg := payload.NewMessage(
+		payload.Routing{
+			Name: "traced",
+			Slip: []payload.Step{
+				{Queue: "foo"},
+				{Queue: "bar", Arguments: payload.Arguments{"fail": true}},
+			},
+		},
+		payload.MetaData{},
+		payload.Documents{},
+	)
+	if err := p.SendMessage(msg); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	sent := pm.TakeDelivery(time.Second)
+	if sent == nil {
+		t.Fatalf("Expected the message to be sent")
+	}
+	m.Deliver(sent)
+
+	next := m.TakeDelivery(time.Second)
+	if next == nil {
+		t.Fatalf("Expected the message to advance")
+	}
+	if s, _ := m.Deliver(next).Settlement(time.Second); s != broker.Acked {
+		t.Errorf("Unexpected settlement. Have %q, want %q.", s, broker.Acked)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Unexpected number of spans. Have %d, want %d.", len(spans), 3)
+	}
+
+	root, foo, bar := spans[0], spans[1], spans[2]
+	for name, tc := range map[string]struct {
+		span   tracetest.SpanStub
+		name   string
+		parent tracetest.SpanStub
+		status codes.Code
+		queue  string
+	}{
+		"root": {root, "traced send", tracetest.SpanStub{}, codes.Unset, ""},
+		"foo":  {foo, "traced foo", root, codes.Unset, "foo"},
+		"bar":  {bar, "traced bar", foo, codes.Error, "bar"},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if tc.span.Name != tc.name {
+				t.Errorf("Unexpected name. Have %q, want %q.", tc.span.Name, tc.name)
+			}
+			if have, want := tc.span.SpanContext.TraceID(), root.SpanContext.TraceID(); have != want {
+				t.Errorf("Unexpected trace. Have %s, want %s.", have, want)
+			}
+			if have, want := tc.span.Parent.SpanID(), tc.parent.SpanContext.SpanID(); have != want {
+				t.Errorf("Unexpected parent. Have %s, want %s.", have, want)
+			}
+			if tc.span.Status.Code != tc.status {
+				t.Errorf("Unexpected status. Have %v, want %v.", tc.span.Status.Code, tc.status)
+			}
+
+			attrs := map[attribute.Key]attribute.Value{}
+			for _, kv := range tc.span.Attributes {
+				attrs[kv.Key] = kv.Value
+			}
+			if have := attrs["gonyexpress.trace_id"].AsString(); have != msg.TraceID {
+				t.Errorf("Unexpected trace_id. Have %q, want %q.", have, msg.TraceID)
+			}
+			if have := attrs["gonyexpress.queue"].AsString(); have != tc.queue {
+				t.Errorf("Unexpected queue. Have %q, want %q.", have, tc.queue)
+			}
+		})
+	}
+}